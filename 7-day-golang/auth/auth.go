@@ -0,0 +1,150 @@
+// Package auth 实现连接级别的认证。服务端接受 Option 之后在握手回复里带一个随机数，
+// 客户端用 Credentials 生成凭证发回去，服务端的 Verifier 验证通过后得到 Principal，
+// 之后这个连接上每个请求的 context 里都有它，可以用 FromContext 取出来做权限判断
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// 内置的认证方式
+const (
+	SchemeBearer = "bearer" // Token 是固定的 bearer token
+	SchemeHMAC   = "hmac"   // Token 是用共享密钥对随机数做的 HMAC-SHA256，ID 是密钥的编号
+)
+
+// Credential 是客户端在握手时发给服务端的凭证
+type Credential struct {
+	Scheme string `json:"Scheme"`
+	ID     string `json:"ID,omitempty"`
+	Token  string `json:"Token"`
+}
+
+// Credentials 由客户端提供，nonce 是服务端这次握手发来的随机数
+type Credentials interface {
+	Credential(nonce string) (*Credential, error)
+}
+
+// CredentialsFunc 把普通函数转成 Credentials
+type CredentialsFunc func(nonce string) (*Credential, error)
+
+func (f CredentialsFunc) Credential(nonce string) (*Credential, error) { return f(nonce) }
+
+// BearerToken 每次都发送同一个 token
+func BearerToken(token string) Credentials {
+	return CredentialsFunc(func(string) (*Credential, error) {
+		return &Credential{Scheme: SchemeBearer, Token: token}, nil
+	})
+}
+
+// HMAC 用 secret 对服务端的随机数签名，密钥本身不会在网络上传输，签名也不能被重放到别的连接
+func HMAC(keyID string, secret []byte) Credentials {
+	return CredentialsFunc(func(nonce string) (*Credential, error) {
+		return &Credential{Scheme: SchemeHMAC, ID: keyID, Token: sign(secret, nonce)}, nil
+	})
+}
+
+func sign(secret []byte, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Principal 是认证通过的调用方
+type Principal struct {
+	Name   string
+	Scheme string
+	Roles  []string // Verifier 可以直接给出角色，服务端的授权策略里也可以按名字配置
+}
+
+// HasRole 判断调用方是否有 role 角色
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier 由服务端提供，返回的 error 会以 Unauthenticated 回复给客户端。
+// ctx 里有连接的 peer.Peer，可以结合 TLS 客户端证书一起判断
+type Verifier interface {
+	Verify(ctx context.Context, nonce string, c *Credential) (*Principal, error)
+}
+
+// VerifierFunc 把普通函数转成 Verifier
+type VerifierFunc func(ctx context.Context, nonce string, c *Credential) (*Principal, error)
+
+func (f VerifierFunc) Verify(ctx context.Context, nonce string, c *Credential) (*Principal, error) {
+	return f(ctx, nonce, c)
+}
+
+// ErrBadCredential 表示凭证不对，不区分是哪一部分不对
+var ErrBadCredential = errors.New("auth: invalid credential")
+
+// Schemes 按 Credential.Scheme 选择 Verifier，用来同时支持多种认证方式
+type Schemes map[string]Verifier
+
+func (s Schemes) Verify(ctx context.Context, nonce string, c *Credential) (*Principal, error) {
+	v, ok := s[c.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("auth: unsupported scheme %q", c.Scheme)
+	}
+	return v.Verify(ctx, nonce, c)
+}
+
+// NewTokenVerifier 验证 bearer token，tokens 是 token 到调用方名字的映射
+func NewTokenVerifier(tokens map[string]string) Verifier {
+	return VerifierFunc(func(ctx context.Context, nonce string, c *Credential) (*Principal, error) {
+		if c.Scheme != SchemeBearer {
+			return nil, ErrBadCredential
+		}
+		for token, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+				return &Principal{Name: name, Scheme: SchemeBearer}, nil
+			}
+		}
+		return nil, ErrBadCredential
+	})
+}
+
+// NewHMACVerifier 验证 HMAC 签名，keys 是密钥编号到密钥的映射，调用方的名字就是密钥编号
+func NewHMACVerifier(keys map[string][]byte) Verifier {
+	return VerifierFunc(func(ctx context.Context, nonce string, c *Credential) (*Principal, error) {
+		secret, ok := keys[c.ID]
+		if c.Scheme != SchemeHMAC || !ok || !hmac.Equal([]byte(sign(secret, nonce)), []byte(c.Token)) {
+			return nil, ErrBadCredential
+		}
+		return &Principal{Name: c.ID, Scheme: SchemeHMAC}, nil
+	})
+}
+
+// NewNonce 生成握手用的随机数
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying p
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the authenticated Principal in ctx
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
@@ -3,11 +3,15 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geerpc/codec"
+	"geerpc/compress"
+	"geerpc/metadata"
 	"geerpc/service"
+	"geerpc/status"
 	"io"
 	"log"
 	"net"
@@ -26,6 +30,8 @@ type Call struct{
 	Reply interface{}
 	Error error
 	Done chan *Call //当一次调用完成，用于通知调用方
+	ctx context.Context // 截止时间会随请求发给服务端
+	stream *Stream // 流式调用的接收端，普通调用为 nil
 
 }
 //支持异步调用，使用channel来通知调用方
@@ -45,6 +51,11 @@ type Client struct{
 	pending map[uint64]*Call
 	closed bool  // user has called Close
 	shutdown bool // server has told us to stop
+	interceptors []Interceptor
+	handshake *handshakeRecorder // 用来识别服务端的握手错误
+	handshakeErr error // 服务端拒绝了握手，之后的调用都返回它而不是 ErrShutdown
+	compress *compress.Stats // 没有压缩时为 nil
+	m codec.Marshaler // 分帧协议的 body 编码，流式调用用它解码消息；老协议为 nil
 }
 var _ io.Closer = (*Client)(nil) //这一步是为了保证client继承了closer接口
 var ErrShutdown = errors.New("connection is shut down")
@@ -75,7 +86,7 @@ func (cli *Client) registerCall(call *Call)  (uint64,error){
 	cli.mu.Lock()
 	defer cli.mu.Unlock()
 	if cli.shutdown || cli.closed{
-		return 0,ErrShutdown
+		return 0,cli.shutdownErr()
 	}
 	//如果客户端没有关闭
 	call.Seq=cli.seq
@@ -83,6 +94,14 @@ func (cli *Client) registerCall(call *Call)  (uint64,error){
 	cli.seq++
 	return call.Seq,nil
 }
+// shutdownErr 是连接不可用时新调用的错误，调用时要持有 mu
+func (cli *Client) shutdownErr() error {
+	if cli.handshakeErr != nil && !cli.closed {
+		return cli.handshakeErr
+	}
+	return ErrShutdown
+}
+
 func (cli *Client) removeCall(seq uint64) *Call {
 	cli.mu.Lock()
 	defer cli.mu.Unlock()
@@ -111,50 +130,185 @@ func (cli *Client) receive(){
 		if err = cli.c.ReadHeader(&h);err !=nil{
 			break
 		}
+		if h.Seq != 0 {
+			cli.handshake.stop() // 收到了正常的回复
+		}
+		switch h.Kind {
+		case codec.KindStreamMsg:
+			err = cli.receiveStream(&h)
+			continue
+		case codec.KindWindowUpdate:
+			cli.grant(&h)
+			err = cli.c.ReadBody(nil)
+			continue
+		}
 		call := cli.removeCall(h.Seq)
+		if call != nil && h.Meta != nil {
+			metadata.DeliverResponse(call.ctx, h.Meta)
+		}
 		switch  {
 		case call == nil:
 			//call位nil，证明这个调用已经被停止了
 			err = cli.c.ReadBody(nil) //把body从io读出来
-		case h.Error !="":
+		case h.Error !="" || h.Code != 0:
 			//call存在但是error不为空，服务端报错
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = headerError(&h)
 			err = cli.c.ReadBody(nil)
 			call.done()
 		default:
 			err = cli.c.ReadBody(call.Reply)
-			if err != nil {
+			if _, ok := status.FromError(err); ok {
+				// 分帧协议已经跳过了这个 body，只影响这一次调用
+				call.Error, err = err, nil
+			} else if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
 			call.done()
 		}
 	}
+	// 服务端拒绝了握手，把它的错误告诉调用方，而不是一个解码错误
+	if herr := cli.handshake.err(); herr != nil {
+		err = herr
+		cli.mu.Lock()
+		cli.handshakeErr = herr // 老协议的服务端可能在第一个调用发出之前就关闭了连接
+		cli.mu.Unlock()
+	}
 	//call 有错误，要结束这个客户端
 	cli.terminateCalls(err)
 }
 
+// headerError 把回复 header 里的错误还原成 *status.Status，老的服务端没有错误码时为 Unknown
+func headerError(h *codec.Header) error {
+	code := status.Code(h.Code)
+	if code == status.OK {
+		code = status.Unknown
+	}
+	return &status.Status{Code: code, Message: h.Error, Details: h.Details}
+}
+
+// callFailed 把 context 的错误转成 Canceled 或 DeadlineExceeded
+func callFailed(err error) error {
+	st := status.FromContextError(err)
+	st.Message = "rpc client: call failed: " + st.Message
+	return st
+}
+
 //创建Client实例
 func NewClient(conn net.Conn,opt *service.Option) (*Client,error){
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f ==nil{
+	f, ok := codec.Get(opt.CodecType)
+	if !ok{
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	if _, ok := compress.Get(opt.Compressor); opt.Compressor != "" && !ok {
+		err := fmt.Errorf("invalid compressor %s", opt.Compressor)
+		log.Println("rpc client: compress error:", err)
+		return nil, err
+	}
+	if m, ok := codec.GetMarshaler(opt.CodecType); ok && !opt.Legacy {
+		return newFramedClient(conn, m, opt)
+	}
+	if opt.Credentials != nil {
+		err := status.New(status.Unimplemented, "rpc client: credentials require the framed protocol")
+		log.Println("rpc client: auth error:", err)
+		return nil, err
+	}
 	//要把option先发给服务端
 	if err := json.NewEncoder(conn).Encode(opt); err != nil{
 		log.Println("rpc client: options error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	// 记录的是压缩之前的原始数据，服务端拒绝握手时写的 JSON 没有压缩
+	rec := &handshakeRecorder{ReadWriteCloser: conn}
+	rwc, stats := compressConn(rec, opt)
+	client := newClientCodec(codec.FlushWrites(f(rwc), rwc), opt, rec)
+	client.compress = stats
+	return client, nil
+}
+
+// compressConn 按 Option 里的压缩算法包装连接，不压缩时原样返回，stats 为 nil
+func compressConn(conn io.ReadWriteCloser, opt *service.Option) (io.ReadWriteCloser, *compress.Stats) {
+	if opt.Compressor == "" {
+		return conn, nil
+	}
+	cp, _ := compress.Get(opt.Compressor)
+	c := compress.NewConn(conn, cp, opt.CompressMinSize, nil)
+	return c, c.Stats()
+}
+
+// CompressionStats 返回这个连接压缩前后的字节数，没有压缩时都是 0
+func (cli *Client) CompressionStats() compress.Stats {
+	if cli.compress == nil {
+		return compress.Stats{}
+	}
+	return cli.compress.Snapshot()
+}
+
+// newFramedClient 用分帧协议握手，服务端拒绝时直接返回它的错误
+func newFramedClient(conn net.Conn, m codec.Marshaler, opt *service.Option) (*Client, error) {
+	c := codec.NewFrameCodec(conn, m, opt.MaxMessageSize)
+	if err := c.WriteHandshake(opt); err != nil {
+		log.Println("rpc client: options error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	var reply service.HandshakeReply
+	if err := c.ReadHandshake(&reply); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc client: handshake error, protocol mismatch? %w", err)
+	}
+	if reply.Error != "" {
+		_ = conn.Close()
+		return nil, handshakeError(&reply)
+	}
+	if reply.Nonce != "" {
+		if err := authenticate(c, opt, reply.Nonce); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if opt.Compressor == "" {
+		client := newClientCodec(c, opt, nil)
+		client.m = m
+		return client, nil
+	}
+	// 服务端在握手回复之后才开始压缩，这之前不会再发数据
+	rwc, stats := compressConn(conn, opt)
+	client := newClientCodec(codec.NewFrameCodec(rwc, m, opt.MaxMessageSize), opt, nil)
+	client.compress, client.m = stats, m
+	return client, nil
+}
+// authenticate 用 Credentials 回应服务端的随机数，服务端认证失败时返回它的错误
+func authenticate(c *codec.FrameCodec, opt *service.Option, nonce string) error {
+	if opt.Credentials == nil {
+		return status.New(status.Unauthenticated, "rpc client: server requires credentials")
+	}
+	cred, err := opt.Credentials.Credential(nonce)
+	if err != nil {
+		return status.Errorf(status.Unauthenticated, "rpc client: can't get credential: %v", err)
+	}
+	if err := c.WriteHandshake(cred); err != nil {
+		return err
+	}
+	var reply service.HandshakeReply
+	if err := c.ReadHandshake(&reply); err != nil {
+		return fmt.Errorf("rpc client: auth error: %w", err)
+	}
+	if reply.Error != "" {
+		return handshakeError(&reply)
+	}
+	return nil
 }
-func newClientCodec(c codec.Codec,opt *service.Option) *Client{
+
+func newClientCodec(c codec.Codec,opt *service.Option, rec *handshakeRecorder) *Client{
 	client := &Client{
 		c:c,
 		seq:1,
 		opt:opt,
 		pending: make(map[uint64]*Call),
+		handshake: rec,
 	}
 	go client.receive()
 	return client
@@ -222,6 +376,12 @@ func parseOptions(opts ...*service.Option)(*service.Option,error){
 func (cli *Client) send(call *Call) {
 	cli.sending.Lock()
 	defer cli.sending.Unlock()
+	if err := call.ctx.Err(); err != nil {
+		// 已经超时或取消的调用不用再发出去
+		call.Error = callFailed(err)
+		call.done()
+		return
+	}
 	seq, err := cli.registerCall(call)//发送得先注册到client
 	if err != nil {
 		call.Error = err
@@ -231,9 +391,15 @@ func (cli *Client) send(call *Call) {
 	cli.h.ServiceMethod = call.ServiceMethod
 	cli.h.Seq = seq
 	cli.h.Error=""
+	cli.h.Timeout = 0
+	cli.h.Kind, cli.h.Credit = codec.KindRequest, 0
+	if call.stream != nil {
+		cli.h.Kind, cli.h.Credit = codec.KindStreamOpen, uint32(cap(call.stream.msgs))
+	}
+	setCallContext(&cli.h, call.ctx)
 
 	//encode
-	if err := cli.c.Write(&cli.h,&call.Args);err!=nil{
+	if err := cli.c.Write(&cli.h,call.Args);err!=nil{
 		call := cli.removeCall(seq)
 
 		if call !=nil{
@@ -246,9 +412,61 @@ func (cli *Client) send(call *Call) {
 }
 
 
+// setCallContext 把 ctx 里的元数据和截止时间放进请求的 header
+func setCallContext(h *codec.Header, ctx context.Context) {
+	h.Meta, _ = metadata.FromOutgoingContext(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		// 只传剩余时间，避免两端时钟不一致
+		h.Timeout = time.Until(deadline)
+		if h.Timeout <= 0 {
+			h.Timeout = 1
+		}
+	}
+}
+
+// Notify 发起一个单向调用，请求写出去就返回，不等待也不会收到回复，服务端的错误只会记在服务端的日志里。
+// 单向调用不占用 pending，也不经过拦截器；ctx 的元数据和截止时间仍然会传给服务端
+func (cli *Client) Notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return callFailed(err)
+	}
+	cli.sending.Lock()
+	defer cli.sending.Unlock()
+	cli.mu.Lock()
+	if cli.shutdown || cli.closed {
+		cli.mu.Unlock()
+		return cli.shutdownErr()
+	}
+	// 序列号仍然要分配，服务端按序列号记录正在处理的请求
+	seq := cli.seq
+	cli.seq++
+	cli.mu.Unlock()
+	h := &codec.Header{ServiceMethod: serviceMethod, Seq: seq, Kind: codec.KindOneWay}
+	setCallContext(h, ctx)
+	return cli.c.Write(h, args)
+}
+
+// sendCancel 通知服务端放弃序列号为 seq 的请求
+func (cli *Client) sendCancel(seq uint64) {
+	cli.sendControl(&codec.Header{Seq: seq, Kind: codec.KindCancel})
+}
+
+// sendControl 发送一个 body 为空占位的控制帧
+func (cli *Client) sendControl(h *codec.Header) {
+	cli.sending.Lock()
+	defer cli.sending.Unlock()
+	if err := cli.c.Write(h, struct{}{}); err != nil {
+		log.Println("rpc client: send control frame error:", err)
+	}
+}
+
 //下面的Go和Call是客户端暴露出来的Rpc调用接口
 
 func (cli *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	return cli.goContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+func (cli *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
@@ -259,17 +477,37 @@ func (cli *Client) Go(serviceMethod string, args, reply interface{}, done chan *
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		ctx:           ctx,
 	}
 	cli.send(call)
 	return call
 }
 
 func (cli *Client) Call(ctx context.Context,serviceMethod string, args, reply interface{}) error {
-	call := cli.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	cli.mu.Lock()
+	interceptors := cli.interceptors
+	cli.mu.Unlock()
+	if len(interceptors) == 0 {
+		return cli.invoke(ctx, serviceMethod, args, reply)
+	}
+	return chainInterceptors(interceptors, cli.invoke)(ctx, serviceMethod, args, reply)
+}
+
+// Ping 调用服务端内置的 service.PingMethod，不经过拦截器。
+// 参数和回复都是空占位，用哪种编解码器都能调用
+func (cli *Client) Ping(ctx context.Context) error {
+	return cli.invoke(ctx, service.PingMethod, struct{}{}, nil)
+}
+
+// invoke 发出请求并等待回复，是拦截器链的最里层
+func (cli *Client) invoke(ctx context.Context,serviceMethod string, args, reply interface{}) error {
+	call := cli.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 	select {
 		case <-ctx.Done():
-			cli.removeCall(call.Seq)
-			return errors.New("rpc client: call failed: " + ctx.Err().Error())
+			if cli.removeCall(call.Seq) != nil {
+				cli.sendCancel(call.Seq) // 还没有收到回复，让服务端停止处理
+			}
+			return callFailed(ctx.Err())
 		case call := <-call.Done:
 			return call.Error
 	}
@@ -298,6 +536,33 @@ func DialHTTP(network, address string, opts ...*service.Option) (*Client, error)
 	return dialTimeout(NewHTTPClient, network, address, opts...)
 }
 
+// DialTLS 用 TLS 连接服务端，配置来自 Option.TLSConfig，握手也算在 ConnectTimeout 里。
+// 需要双向认证时在 TLSConfig.Certificates 里放客户端证书
+func DialTLS(network, address string, opts ...*service.Option) (*Client, error) {
+	return dialTimeout(func(conn net.Conn, opt *service.Option) (*Client, error) {
+		return newTLSClient(conn, address, opt)
+	}, network, address, opts...)
+}
+
+func newTLSClient(conn net.Conn, address string, opt *service.Option) (*Client, error) {
+	config := &tls.Config{}
+	if opt.TLSConfig != nil {
+		config = opt.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("rpc client: tls handshake error: %w", err)
+	}
+	return NewClient(tc, opt)
+}
+
 func XDial(rpcAddr string, opts ...*service.Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -307,6 +572,8 @@ func XDial(rpcAddr string, opts ...*service.Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		return DialTLS("tcp", addr, opts...)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
@@ -2,12 +2,30 @@ package client
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"geerpc/auth"
+	"geerpc/codec"
+	"geerpc/compress"
+	"geerpc/metadata"
+	"geerpc/peer"
 	"geerpc/service"
+	"geerpc/status"
+	"io"
+	"math/big"
 	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type Bar int
@@ -17,6 +35,141 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+// waited 在 Bar.Wait 的 context 被取消后收到通知
+var waited = make(chan error, 1)
+
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	<-ctx.Done()
+	waited <- ctx.Err()
+	return ctx.Err()
+}
+
+// Budget 返回 context 剩余的毫秒数，没有截止时间返回 -1
+func (b Bar) Budget(ctx context.Context, argv int, reply *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		*reply = -1
+		return nil
+	}
+	*reply = int64(time.Until(deadline) / time.Millisecond)
+	return nil
+}
+
+// Trace 把请求元数据里的 trace-id 原样返回，并在回复元数据里带上 served-by
+func (b Bar) Trace(ctx context.Context, argv int, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md.Get("trace-id")
+	return metadata.SetResponse(ctx, metadata.Pairs("served-by", "bar"))
+}
+
+func (b Bar) Panic(argv int, reply *int) error {
+	panic("bar panic")
+}
+
+// Refuse 返回带错误码和附加信息的错误
+func (b Bar) Refuse(argv int, reply *int) error {
+	return status.New(status.PermissionDenied, "admin only").WithDetails("role", "admin")
+}
+
+// Upper 用 protobuf 消息做参数和回复
+func (b Bar) Upper(ctx context.Context, argv *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	reply.Value = strings.ToUpper(argv.Value) + md.Get("suffix")
+	return nil
+}
+
+// Repeat 返回重复 argv 次的字符串，用来构造大的回复
+func (b Bar) Repeat(argv int, reply *string) error {
+	*reply = strings.Repeat("geerpc ", argv)
+	return nil
+}
+
+// Count 依次发送 0 到 argv-1
+func (b Bar) Count(argv int, stream service.ServerStream) error {
+	for i := 0; i < argv; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tailSent 记录 Bar.Tail 发出去的消息数
+var tailSent int64
+
+// Tail 一直发送，直到客户端取消
+func (b Bar) Tail(ctx context.Context, argv int, stream service.ServerStream) error {
+	for {
+		if err := stream.Send(argv); err != nil {
+			waited <- ctx.Err()
+			return err
+		}
+		atomic.AddInt64(&tailSent, 1)
+	}
+}
+
+// Total 累加客户端发来的所有数
+func (b Bar) Total(stream service.ClientStream, reply *int) error {
+	for {
+		var i int
+		if err := stream.Recv(&i); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		*reply += i
+	}
+}
+
+// Echo 把收到的每条消息加上 argv 前缀发回去
+func (b Bar) Echo(ctx context.Context, stream service.BidiStream) error {
+	for {
+		var msg string
+		if err := stream.Recv(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send("echo " + msg); err != nil {
+			return err
+		}
+	}
+}
+
+// holding 记录正在执行的 Bar.Hold，release 放行一个
+var (
+	holding int64
+	release = make(chan struct{})
+)
+
+// Hold 阻塞到 release 放行，用来测试单向调用的并发限制
+func (b Bar) Hold(argv int, reply *int) error {
+	atomic.AddInt64(&holding, 1)
+	defer atomic.AddInt64(&holding, -1)
+	<-release
+	return nil
+}
+
+// Principal 返回认证通过的调用方
+func (b Bar) Principal(ctx context.Context, argv int, reply *string) error {
+	p, ok := auth.FromContext(ctx)
+	if !ok {
+		return status.New(status.Unauthenticated, "no principal in context")
+	}
+	*reply = p.Scheme + ":" + p.Name
+	return nil
+}
+
+// Whoami 返回 TLS 客户端证书里的身份
+func (b Bar) Whoami(ctx context.Context, argv int, reply *string) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return errors.New("no peer in context")
+	}
+	*reply = p.Identity()
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = service.Register(&b)
@@ -34,11 +187,12 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		fmt.Println("err:",strings.Contains(err.Error(), ctx.Err().Error()))
-		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
+		_assert(status.CodeOf(err) == status.DeadlineExceeded && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &service.Option{
@@ -46,11 +200,520 @@ func TestClient_Call(t *testing.T) {
 		})
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
-		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(status.CodeOf(err) == status.DeadlineExceeded && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+	})
+	t.Run("handler canceled on handle timeout", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &service.Option{
+			HandleTimeout: time.Second,
+		})
+		defer func() { _ = client.Close() }()
+		var reply int
+		err := client.Call(context.Background(), "Bar.Wait", 1, &reply)
+		_assert(status.CodeOf(err) == status.DeadlineExceeded && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(<-waited == context.DeadlineExceeded, "expect handler context deadline exceeded")
+	})
+	t.Run("handler canceled by client", func(t *testing.T) {
+		for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+			client, _ := Dial("tcp", addr, &service.Option{CodecType: typ})
+			// 用 WithCancel 而不是 WithTimeout，避免截止时间随请求传到服务端
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(time.Millisecond*100, cancel)
+			var reply int
+			err := client.Call(ctx, "Bar.Wait", 1, &reply)
+			_assert(status.CodeOf(err) == status.Canceled && strings.Contains(err.Error(), ctx.Err().Error()), "expect a canceled error")
+			select {
+			case err := <-waited:
+				_assert(err == context.Canceled, "expect handler context canceled")
+			case <-time.After(time.Second):
+				t.Fatalf("%s: handler context not canceled by cancel frame", typ)
+			}
+			_assert(client.IsAvailable(), "%s: client should survive a canceled call", typ)
+			_ = client.Close()
+		}
+	})
+	t.Run("deadline propagated to handler", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		defer func() { _ = client.Close() }()
+		var reply int64
+		err := client.Call(context.Background(), "Bar.Budget", 1, &reply)
+		_assert(err == nil && reply == -1, "expect no deadline, but got %d", reply)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = client.Call(ctx, "Bar.Budget", 1, &reply)
+		_assert(err == nil && reply > 500 && reply <= 1000, "expect remaining budget within 1s, but got %d", reply)
+	})
+	t.Run("metadata round trip", func(t *testing.T) {
+		for i, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.GobType, codec.JsonType, codec.MsgpackType} {
+			client, _ := Dial("tcp", addr, &service.Option{CodecType: typ, Legacy: i >= 3})
+			var resp metadata.MD
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "trace-id", "abc")
+			ctx = metadata.WithResponse(ctx, &resp)
+			var reply string
+			err := client.Call(ctx, "Bar.Trace", 1, &reply)
+			_assert(err == nil && reply == "abc", "%s: expect trace-id abc, but got %q", typ, reply)
+			_assert(resp.Get("served-by") == "bar", "%s: expect response metadata, but got %v", typ, resp)
+			_ = client.Close()
+		}
+	})
+	t.Run("interceptors", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		defer func() { _ = client.Close() }()
+		var order []string
+		client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+			order = append(order, "first:"+serviceMethod)
+			return invoker(ctx, serviceMethod, args, reply)
+		}, func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+			order = append(order, "second")
+			ctx = metadata.AppendToOutgoingContext(ctx, "trace-id", "from-interceptor")
+			return invoker(ctx, serviceMethod, args, reply)
+		})
+		var reply string
+		err := client.Call(context.Background(), "Bar.Trace", 1, &reply)
+		_assert(err == nil && reply == "from-interceptor", "expect metadata set by interceptor, but got %q", reply)
+		_assert(strings.Join(order, ",") == "first:Bar.Trace,second", "wrong interceptor order %v", order)
+	})
+	t.Run("server recovers panic", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		defer func() { _ = client.Close() }()
+		var reply int
+		err := client.Call(context.Background(), "Bar.Panic", 1, &reply)
+		_assert(errors.Is(err, service.ErrInternal) && strings.Contains(err.Error(), "bar panic"), "expect internal error, but got %v", err)
+		_assert(client.IsAvailable(), "client should survive a server panic")
+	})
+	t.Run("status codes", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		defer func() { _ = client.Close() }()
+		var reply int
+		err := client.Call(context.Background(), "Bar.NotExist", 1, &reply)
+		st, ok := status.FromError(err)
+		_assert(ok && st.Code == status.NotFound, "expect NotFound, but got %v", err)
+		err = client.Call(context.Background(), "Bar.Refuse", 1, &reply)
+		st, ok = status.FromError(err)
+		_assert(ok && st.Code == status.PermissionDenied && st.Details["role"] == "admin", "expect PermissionDenied with details, but got %v", err)
+	})
+	t.Run("protobuf codec", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &service.Option{CodecType: codec.ProtobufType})
+		defer func() { _ = client.Close() }()
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "suffix", "!")
+		reply := &wrapperspb.StringValue{}
+		err := client.Call(ctx, "Bar.Upper", wrapperspb.String("geerpc"), reply)
+		_assert(err == nil && reply.Value == "GEERPC!", "expect GEERPC!, but got %q (%v)", reply.Value, err)
+
+		err = client.Call(ctx, "Bar.NotExist", wrapperspb.String("geerpc"), reply)
+		_assert(status.CodeOf(err) == status.NotFound, "expect NotFound, but got %v", err)
+		_assert(client.IsAvailable(), "client should survive an error reply")
+	})
+	t.Run("server streaming", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &service.Option{CodecType: codec.GobType})
+		defer func() { _ = client.Close() }()
+		stream, err := client.Stream(context.Background(), "Bar.Count", 100)
+		_assert(err == nil, "expect stream to open, but got %v", err)
+		n := 0
+		for stream.Next() {
+			var i int
+			err = stream.Scan(&i)
+			_assert(err == nil && i == n, "expect message %d, but got %d (%v)", n, i, err)
+			n++
+		}
+		_assert(stream.Err() == nil && n == 100, "expect 100 messages, but got %d (%v)", n, stream.Err())
+
+		// 不读消息时服务端最多发出一个窗口
+		atomic.StoreInt64(&tailSent, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, _ = client.Stream(ctx, "Bar.Tail", 1)
+		time.Sleep(time.Millisecond * 200)
+		sent := atomic.LoadInt64(&tailSent)
+		_assert(sent > 0 && sent <= codec.DefaultStreamWindow, "expect at most one window in flight, but sent %d", sent)
+		_assert(stream.Next(), "expect a buffered message")
+		cancel()
+		select {
+		case err := <-waited:
+			_assert(err == context.Canceled, "expect handler context canceled")
+		case <-time.After(time.Second):
+			t.Fatal("stream handler not canceled by context")
+		}
+		for stream.Next() {
+		}
+		_assert(status.CodeOf(stream.Err()) == status.Canceled, "expect Canceled, but got %v", stream.Err())
+
+		err = client.Call(context.Background(), "Bar.Count", 1, new(int))
+		_assert(status.CodeOf(err) == status.InvalidArgument, "expect InvalidArgument, but got %v", err)
+		legacy, _ := Dial("tcp", addr, &service.Option{CodecType: codec.GobType, Legacy: true})
+		defer func() { _ = legacy.Close() }()
+		_, err = legacy.Stream(context.Background(), "Bar.Count", 1)
+		_assert(status.CodeOf(err) == status.Unimplemented, "expect Unimplemented, but got %v", err)
+		_assert(client.IsAvailable(), "client should survive streams")
+	})
+	t.Run("client and bidi streaming", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &service.Option{CodecType: codec.MsgpackType})
+		defer func() { _ = client.Close() }()
+		stream, err := client.OpenStream(context.Background(), "Bar.Total")
+		_assert(err == nil, "expect stream to open, but got %v", err)
+		for i := 1; i <= 100; i++ {
+			err = stream.Send(i)
+			_assert(err == nil, "send error: %v", err)
+		}
+		var total int
+		err = stream.CloseAndRecv(&total)
+		_assert(err == nil && total == 5050, "expect 5050, but got %d (%v)", total, err)
+
+		// 两个双向流共用一个连接
+		errs := make(chan error, 2)
+		for _, prefix := range []string{"a", "b"} {
+			go func(prefix string) {
+				stream, err := client.OpenStream(context.Background(), "Bar.Echo")
+				if err != nil {
+					errs <- err
+					return
+				}
+				go func() {
+					for i := 0; i < 100; i++ {
+						_ = stream.Send(fmt.Sprintf("%s%d", prefix, i))
+					}
+					_ = stream.CloseSend()
+				}()
+				n := 0
+				for ; stream.Next(); n++ {
+					var msg string
+					if err := stream.Scan(&msg); err != nil || msg != fmt.Sprintf("echo %s%d", prefix, n) {
+						errs <- fmt.Errorf("unexpected message %q (%v)", msg, err)
+						return
+					}
+				}
+				if stream.Err() == nil && n != 100 {
+					errs <- fmt.Errorf("%s: expect 100 echoes, but got %d", prefix, n)
+					return
+				}
+				errs <- stream.Err()
+			}(prefix)
+		}
+		for i := 0; i < 2; i++ {
+			err := <-errs
+			_assert(err == nil, "bidi stream error: %v", err)
+		}
 	})
+	t.Run("handler canceled on disconnect", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		_ = client.Go("Bar.Wait", 1, new(int), nil)
+		time.Sleep(time.Millisecond * 100)
+		_ = client.Close()
+		select {
+		case err := <-waited:
+			_assert(err == context.Canceled, "expect handler context canceled")
+		case <-time.After(time.Second):
+			t.Fatal("handler context not canceled after disconnect")
+		}
+	})
+}
+func TestClient_CodecNegotiation(t *testing.T) {
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	server.SetCodecs(codec.GobType)
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	// 分帧协议在握手时就会失败
+	_, err := Dial("tcp", l.Addr().String(), &service.Option{CodecType: codec.JsonType})
+	_assert(status.CodeOf(err) == status.Unimplemented, "expect Unimplemented, but got %v", err)
+	codecs := ServerCodecs(err)
+	_assert(len(codecs) == 1 && codecs[0] == codec.GobType, "expect server codecs [gob], but got %v", codecs)
+
+	// 老协议的服务端不回复握手成功，第一次调用时才能拿到错误
+	client, err := Dial("tcp", l.Addr().String(), &service.Option{CodecType: codec.JsonType, Legacy: true})
+	_assert(err == nil, "dial should succeed before the server answers")
+	var reply int
+	err = client.Call(context.Background(), "Bar.Budget", 1, &reply)
+	_assert(status.CodeOf(err) == status.Unimplemented, "expect Unimplemented, but got %v", err)
+	codecs = ServerCodecs(err)
+	_assert(len(codecs) == 1 && codecs[0] == codec.GobType, "expect server codecs [gob], but got %v", codecs)
+
+	client, _ = Dial("tcp", l.Addr().String(), &service.Option{CodecType: codec.GobType})
+	defer func() { _ = client.Close() }()
+	err = client.Call(context.Background(), "Bar.Budget", 1, &reply)
+	_assert(err == nil, "expect gob to be accepted, but got %v", err)
+
+	// 没有 Marshaler 的编解码器只能走老协议，分帧协议的握手不告诉客户端
+	const legacyOnly codec.Type = "application/x-legacy-gob"
+	codec.Register(legacyOnly, codec.NewGobCodec)
+	server2 := service.NewServer()
+	_ = server2.Register(&b)
+	server2.SetCodecs(codec.GobType, legacyOnly)
+	l2, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l2.Close() }()
+	go server2.Accept(l2)
+	_, err = Dial("tcp", l2.Addr().String(), &service.Option{CodecType: codec.JsonType})
+	codecs = ServerCodecs(err)
+	_assert(len(codecs) == 1 && codecs[0] == codec.GobType, "expect only framed codecs, but got %v", codecs)
+	client2, _ := Dial("tcp", l2.Addr().String(), &service.Option{CodecType: codec.JsonType, Legacy: true})
+	err = client2.Call(context.Background(), "Bar.Budget", 1, &reply)
+	codecs = ServerCodecs(err)
+	_assert(hasCodec(codecs, legacyOnly), "expect legacy codecs in a legacy rejection, but got %v", codecs)
+	client2, _ = Dial("tcp", l2.Addr().String(), &service.Option{CodecType: legacyOnly, Legacy: true})
+	defer func() { _ = client2.Close() }()
+	err = client2.Call(context.Background(), "Bar.Budget", 1, &reply)
+	_assert(err == nil, "expect the legacy-only codec to work over the legacy protocol, but got %v", err)
+}
+
+func hasCodec(types []codec.Type, t codec.Type) bool {
+	for _, c := range types {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClient_Compression(t *testing.T) {
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, name := range []string{compress.Gzip, compress.Snappy} {
+		for _, legacy := range []bool{false, true} {
+			client, err := Dial("tcp", l.Addr().String(), &service.Option{CodecType: codec.GobType, Compressor: name, Legacy: legacy})
+			_assert(err == nil, "%s: dial error: %v", name, err)
+			var reply string
+			err = client.Call(context.Background(), "Bar.Repeat", 1, &reply)
+			_assert(err == nil && reply == "geerpc ", "%s: expect a small reply, but got %v", name, err)
+			stats := client.CompressionStats()
+			_assert(stats.CompressedBlocksSent == 0 && stats.CompressedBlocksReceived == 0, "%s: small messages should not be compressed: %+v", name, stats)
+
+			err = client.Call(context.Background(), "Bar.Repeat", 1<<18, &reply)
+			_assert(err == nil && len(reply) == 7<<18, "%s: expect a large reply, but got %v", name, err)
+			stats = client.CompressionStats()
+			_assert(stats.CompressedBlocksReceived > 0 && stats.WireBytesReceived*10 < stats.BytesReceived, "%s: large replies should be compressed: %+v", name, stats)
+			_ = client.Close()
+		}
+	}
+	stats := server.CompressionStats()
+	_assert(stats.WireBytesSent < stats.BytesSent && stats.BytesReceived > 0, "server stats should record compression: %+v", stats)
+
+	_, err := Dial("tcp", l.Addr().String(), &service.Option{Compressor: "lz4"})
+	_assert(err != nil, "expect an unknown compressor to be rejected")
+}
+
+func TestClient_Notify(t *testing.T) {
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	server.SetMaxOneWay(2)
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 5; i++ {
+		err := client.Notify(context.Background(), "Bar.Hold", i)
+		_assert(err == nil, "notify error: %v", err)
+	}
+	_ = client.Notify(context.Background(), "Bar.NotExist", 1)
+	client.mu.Lock()
+	pending := len(client.pending)
+	client.mu.Unlock()
+	_assert(pending == 0, "one-way calls should not be pending, but got %d", pending)
+
+	time.Sleep(time.Millisecond * 100)
+	_assert(atomic.LoadInt64(&holding) == 2, "expect 2 one-way calls in flight, but got %d", atomic.LoadInt64(&holding))
+	for i := 0; i < 2; i++ {
+		release <- struct{}{}
+	}
+	// 错误的单向调用没有回复，连接还能正常使用
+	var reply int64
+	err := client.Call(context.Background(), "Bar.Budget", 1, &reply)
+	_assert(err == nil && reply == -1 && client.IsAvailable(), "expect a normal call after one-way calls, but got %v", err)
+
+	// 处理超时后不理会 ctx 的方法还在执行，仍然占着名额
+	timed, _ := Dial("tcp", l.Addr().String(), &service.Option{HandleTimeout: time.Millisecond * 10})
+	defer func() { _ = timed.Close() }()
+	for i := 0; i < 20; i++ {
+		_ = timed.Notify(context.Background(), "Bar.Hold", i)
+	}
+	time.Sleep(time.Millisecond * 100)
+	_assert(atomic.LoadInt64(&holding) == 2, "expect timed out one-way calls to keep their slots, but got %d in flight", atomic.LoadInt64(&holding))
+	for i := 0; i < 2; i++ {
+		release <- struct{}{}
+	}
+}
+
+func TestClient_NotifyDisconnect(t *testing.T) {
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	server.SetMaxOneWay(1)
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	// 名额满了之后服务端还在读，客户端断开时正在处理的单向调用会被取消
+	client, _ := Dial("tcp", l.Addr().String())
+	for i := 0; i < 3; i++ {
+		_ = client.Notify(context.Background(), "Bar.Wait", i)
+	}
+	time.Sleep(time.Millisecond * 50)
+	_ = client.Close()
+	select {
+	case err := <-waited:
+		_assert(err == context.Canceled, "expect one-way call to be canceled, but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect one-way call to be canceled after the client disconnected")
+	}
+}
+
+// testCA 是测试时临时生成的 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "geerpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue 签发一个叶子证书，名字是 IP 时作为服务端证书
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClient_TLS(t *testing.T) {
+	ca := newTestCA(t)
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	l, err := service.ListenTLS("tcp", "127.0.0.1:0", service.NewTLSConfig(ca.issue(t, "127.0.0.1"), ca.pool))
+	_assert(err == nil, "listen error: %v", err)
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, legacy := range []bool{false, true} {
+		client, err := XDial("tls@"+l.Addr().String(), &service.Option{
+			Legacy:    legacy,
+			TLSConfig: &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.issue(t, "alice")}},
+		})
+		_assert(err == nil, "dial error: %v", err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+		_assert(err == nil && reply == "alice", "expect peer identity alice, but got %q (%v)", reply, err)
+		_ = client.Close()
+	}
+
+	// 没有客户端证书时握手失败
+	client, err := XDial("tls@"+l.Addr().String(), &service.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	if err == nil {
+		var reply string
+		err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+		_ = client.Close()
+	}
+	_assert(err != nil, "expect a client without certificate to be rejected")
 }
+
+func TestRegisterCodec(t *testing.T) {
+	const typ codec.Type = "application/x-gob-test"
+	codec.Register(typ, codec.NewGobCodec)
+	_, ok := codec.Get(typ)
+	_assert(ok, "expect %s to be registered", typ)
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, _ := Dial("tcp", <-addrCh, &service.Option{CodecType: typ})
+	defer func() { _ = client.Close() }()
+	var reply int64
+	err := client.Call(context.Background(), "Bar.Budget", 1, &reply)
+	_assert(err == nil && reply == -1, "expect a call with a runtime registered codec to succeed, but got %v", err)
+}
+
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
 		panic(fmt.Sprintf("assertion failed: "+msg, v...))
 	}
-}
\ No newline at end of file
+}
+func TestClient_Auth(t *testing.T) {
+	server := service.NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	secret := []byte("s3cret")
+	server.SetVerifier(auth.Schemes{
+		auth.SchemeBearer: auth.NewTokenVerifier(map[string]string{"t0ken": "alice"}),
+		auth.SchemeHMAC:   auth.NewHMACVerifier(map[string][]byte{"bob": secret}),
+	})
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	addr := l.Addr().String()
+
+	cases := map[string]auth.Credentials{
+		"bearer:alice": auth.BearerToken("t0ken"),
+		"hmac:bob":     auth.HMAC("bob", secret),
+	}
+	for want, creds := range cases {
+		client, err := Dial("tcp", addr, &service.Option{Credentials: creds, Compressor: compress.Gzip})
+		_assert(err == nil, "%s: dial error: %v", want, err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Principal", 1, &reply)
+		_assert(err == nil && reply == want, "expect principal %s, but got %q (%v)", want, reply, err)
+		_ = client.Close()
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		for name, opt := range map[string]*service.Option{
+			"no credentials": {},
+			"wrong token":    {Credentials: auth.BearerToken("guess")},
+			"wrong secret":   {Credentials: auth.HMAC("bob", []byte("guess"))},
+			"unknown scheme": {Credentials: auth.CredentialsFunc(func(string) (*auth.Credential, error) {
+				return &auth.Credential{Scheme: "basic", Token: "t0ken"}, nil
+			})},
+		} {
+			_, err := Dial("tcp", addr, opt)
+			st, _ := status.FromError(err)
+			_assert(st != nil && st.Code == status.Unauthenticated, "%s: expect Unauthenticated, but got %v", name, err)
+		}
+		// 老协议没法完成认证，第一个调用就会收到服务端的拒绝
+		client, err := Dial("tcp", addr, &service.Option{Legacy: true})
+		_assert(err == nil, "legacy dial error: %v", err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Principal", 1, &reply)
+		st, _ := status.FromError(err)
+		_assert(st != nil && st.Code == status.Unauthenticated, "legacy: expect Unauthenticated, but got %v", err)
+		_ = client.Close()
+	})
+}
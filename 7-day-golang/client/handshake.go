@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"geerpc/codec"
+	"geerpc/service"
+	"geerpc/status"
+	"io"
+	"strings"
+)
+
+// 服务端的握手错误很短，超过这个长度就不再记录
+const maxHandshakeRecord = 4096
+
+// handshakeRecorder 记录连接上最开始读到的数据。
+// 服务端拒绝 Option 时会写一段 JSON 然后关闭连接，codec 解不出来，
+// 这时用记录下来的原始数据解析出服务端的错误。只在 receive 的 goroutine 里使用
+type handshakeRecorder struct {
+	io.ReadWriteCloser
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (r *handshakeRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	if !r.stopped && n > 0 {
+		if r.buf.Len()+n > maxHandshakeRecord {
+			r.stop()
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// stop 收到第一个正常的回复后握手肯定成功了，不用再记录
+func (r *handshakeRecorder) stop() {
+	if r == nil {
+		return // 分帧协议在握手时就拿到了服务端的错误，不需要记录
+	}
+	r.stopped = true
+	r.buf = bytes.Buffer{}
+}
+
+// err 返回服务端的握手错误，没有则返回 nil
+func (r *handshakeRecorder) err() error {
+	if r == nil || r.stopped {
+		return nil
+	}
+	var env service.HandshakeEnvelope
+	if json.Unmarshal(bytes.TrimSpace(r.buf.Bytes()), &env) != nil || env.Handshake == nil {
+		return nil
+	}
+	return handshakeError(env.Handshake)
+}
+
+// handshakeError 把服务端的握手错误转成 *status.Status，支持的编解码器和压缩算法放在 Details 里
+func handshakeError(h *service.HandshakeReply) error {
+	codecs := make([]string, len(h.Codecs))
+	for i, t := range h.Codecs {
+		codecs[i] = string(t)
+	}
+	st := status.New(status.Code(h.Code), h.Error).WithDetails("codecs", strings.Join(codecs, ","), "compressors", strings.Join(h.Compressors, ","))
+	if st.Code == status.OK {
+		st.Code = status.Unknown
+	}
+	return st
+}
+
+// ServerCodecs 从握手错误里取出服务端支持的编解码器
+func ServerCodecs(err error) []codec.Type {
+	st, ok := status.FromError(err)
+	if !ok || st.Details["codecs"] == "" {
+		return nil
+	}
+	var types []codec.Type
+	for _, t := range strings.Split(st.Details["codecs"], ",") {
+		types = append(types, codec.Type(t))
+	}
+	return types
+}
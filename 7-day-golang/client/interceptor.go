@@ -0,0 +1,28 @@
+package client
+
+import "context"
+
+// Invoker 真正把请求发出去并等待回复
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// Interceptor 包在每次 Call 外面，请求元数据通过 metadata.FromOutgoingContext 读取，
+// 需要修改时用 metadata.AppendToOutgoingContext 派生新的 ctx 再传给 invoker
+type Interceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// Use 注册客户端拦截器，先注册的在外层。拦截器只作用于 Call，Go 是底层的异步接口不经过拦截器
+func (cli *Client) Use(interceptors ...Interceptor) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	cli.interceptors = append(cli.interceptors, interceptors...)
+}
+
+// chainInterceptors 从里往外把拦截器一层层包到 invoker 上
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"geerpc/codec"
+	"geerpc/status"
+	"io"
+	"sync"
+)
+
+// Stream 是流式调用的客户端，接收消息的用法和 sql.Rows 类似:
+//
+//	stream, err := client.Stream(ctx, "Foo.List", args)
+//	for stream.Next() {
+//		var item Item
+//		err = stream.Scan(&item)
+//	}
+//	err = stream.Err()
+//
+// 收到的消息先放在大小为接收窗口的缓冲里，读走一半后才通知服务端继续发送。
+// 发送消息用 Send，可以和接收在不同的 goroutine 里；Next、Scan、Err、CloseAndRecv 和 Close 不能并发调用
+type Stream struct {
+	cli    *Client
+	call   *Call
+	ctx    context.Context
+	msgs   chan codec.RawMessage // receive 放进来的消息，容量就是接收窗口
+	window *codec.Window         // 服务端的接收窗口
+	done   chan struct{}         // 流结束后关闭，停止监听 ctx
+	once   sync.Once
+
+	cur      codec.RawMessage
+	consumed int // 读走了但还没有通知服务端的消息数
+	finished bool
+	err      error
+
+	sendMu     sync.Mutex
+	sendClosed bool // protected by sendMu
+}
+
+var errNotFramed = status.New(status.Unimplemented, "rpc client: streaming requires the framed protocol")
+
+// Stream 调用服务端流式方法，ctx 结束或者调用 Close 时服务端的方法会被取消。
+// 流式调用不经过拦截器，只支持分帧协议
+func (cli *Client) Stream(ctx context.Context, serviceMethod string, args interface{}) (*Stream, error) {
+	s, err := cli.openStream(ctx, serviceMethod, args, nil)
+	if err == nil {
+		s.sendClosed = true // 服务端流式方法不接收消息，不需要通知服务端
+	}
+	return s, err
+}
+
+// OpenStream 调用客户端流式或双向流式方法，消息通过 Send 发送。
+// 客户端流式方法发完后调用 CloseAndRecv 取得回复，双向流式方法用 Next 和 Scan 接收
+func (cli *Client) OpenStream(ctx context.Context, serviceMethod string) (*Stream, error) {
+	return cli.openStream(ctx, serviceMethod, struct{}{}, new(codec.RawMessage))
+}
+
+// openStream 打开一个流，同一个连接上的多个流按 Seq 区分。
+// reply 不为 nil 时保存最后回复的原始 body，由 CloseAndRecv 解码
+func (cli *Client) openStream(ctx context.Context, serviceMethod string, args interface{}, reply *codec.RawMessage) (*Stream, error) {
+	if cli.m == nil {
+		return nil, errNotFramed
+	}
+	s := &Stream{
+		cli:    cli,
+		ctx:    ctx,
+		msgs:   make(chan codec.RawMessage, codec.DefaultStreamWindow),
+		window: codec.NewWindow(codec.DefaultStreamWindow),
+		done:   make(chan struct{}),
+	}
+	s.call = &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Done:          make(chan *Call, 1),
+		ctx:           ctx,
+		stream:        s,
+	}
+	if reply != nil {
+		s.call.Reply = reply
+	}
+	cli.send(s.call)
+	select {
+	case call := <-s.call.Done:
+		// 没有发出去，或者服务端已经回复了
+		s.stop()
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		s.finished = true
+		return s, nil
+	default:
+	}
+	go s.watch()
+	return s, nil
+}
+
+// Next 等待下一条消息，流结束或者出错时返回 false，这时用 Err 取得错误
+func (s *Stream) Next() bool {
+	for {
+		select {
+		case msg := <-s.msgs:
+			s.take(msg)
+			return true
+		default:
+		}
+		if s.finished {
+			s.cur = nil
+			return false
+		}
+		select {
+		case msg := <-s.msgs:
+			s.take(msg)
+			return true
+		case call := <-s.call.Done:
+			// 最后的回复之前的消息都已经在 msgs 里了，下一轮先把它们读完
+			s.finished, s.err = true, call.Error
+			s.stop()
+		}
+	}
+}
+
+// Scan 把当前消息解码到 v
+func (s *Stream) Scan(v interface{}) error {
+	if s.cur == nil {
+		return errors.New("rpc client: Scan called without a successful Next")
+	}
+	if err := s.cli.m.Unmarshal(s.cur, v); err != nil {
+		return status.Errorf(status.InvalidArgument, "rpc client: can't decode stream message: %v", err)
+	}
+	return nil
+}
+
+// Err 返回流结束的原因，正常结束时为 nil
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Send 发送一条消息，服务端的接收窗口满了会阻塞。流已经结束时返回 io.EOF，结束的原因用 Err 或 CloseAndRecv 取得
+func (s *Stream) Send(v interface{}) error {
+	if err := s.window.Take(s.ctx); err == codec.ErrWindowClosed {
+		return io.EOF
+	} else if err != nil {
+		return callFailed(err)
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendClosed {
+		return errors.New("rpc client: Send called after CloseSend")
+	}
+	cli := s.cli
+	cli.sending.Lock()
+	defer cli.sending.Unlock()
+	cli.mu.Lock()
+	_, ok := cli.pending[s.call.Seq]
+	cli.mu.Unlock()
+	if !ok {
+		return io.EOF
+	}
+	return cli.c.Write(&codec.Header{Seq: s.call.Seq, Kind: codec.KindStreamMsg}, v)
+}
+
+// CloseSend 告诉服务端不会再发送消息了，服务端的 Recv 会返回 io.EOF
+func (s *Stream) CloseSend() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	s.cli.sendControl(&codec.Header{Seq: s.call.Seq, Kind: codec.KindCloseSend})
+	return nil
+}
+
+// CloseAndRecv 结束发送并等待客户端流式方法的回复
+func (s *Stream) CloseAndRecv(reply interface{}) error {
+	if err := s.CloseSend(); err != nil {
+		return err
+	}
+	for s.Next() {
+		// 客户端流式方法不会在流里回复消息
+	}
+	if s.err != nil {
+		return s.err
+	}
+	raw, ok := s.call.Reply.(*codec.RawMessage)
+	if !ok {
+		return errors.New("rpc client: CloseAndRecv called on a server stream")
+	}
+	if err := s.cli.m.Unmarshal(*raw, reply); err != nil {
+		return status.Errorf(status.InvalidArgument, "rpc client: can't decode reply: %v", err)
+	}
+	return nil
+}
+
+// Close 提前结束流，服务端的方法会被取消
+func (s *Stream) Close() error {
+	if !s.finished {
+		s.abort(status.New(status.Canceled, "rpc client: stream closed"))
+		s.finished = true
+	}
+	s.stop()
+	return nil
+}
+
+func (s *Stream) take(msg codec.RawMessage) {
+	s.cur = msg
+	s.consumed++
+	if s.consumed >= cap(s.msgs)/2 && !s.finished {
+		s.cli.sendControl(&codec.Header{Seq: s.call.Seq, Kind: codec.KindWindowUpdate, Credit: uint32(s.consumed)})
+		s.consumed = 0
+	}
+}
+
+// watch 在 ctx 结束时取消流
+func (s *Stream) watch() {
+	select {
+	case <-s.ctx.Done():
+		s.abort(callFailed(s.ctx.Err()))
+	case <-s.done:
+	}
+}
+
+func (s *Stream) stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.window.Close()
+	})
+}
+
+// abort 以 err 结束还在进行的流，并通知服务端停止发送
+func (s *Stream) abort(err error) {
+	if call := s.cli.removeCall(s.call.Seq); call != nil {
+		s.cli.sendCancel(call.Seq)
+		call.Error = err
+		call.done()
+	}
+}
+
+// grant 服务端读走了一批消息，增加对应流的发送窗口
+func (cli *Client) grant(h *codec.Header) {
+	cli.mu.Lock()
+	call := cli.pending[h.Seq]
+	cli.mu.Unlock()
+	if call != nil && call.stream != nil {
+		call.stream.window.Add(int(h.Credit))
+	}
+}
+
+// receiveStream 把流里的一条消息交给对应的 Stream，body 等到 Scan 时再解码
+func (cli *Client) receiveStream(h *codec.Header) error {
+	cli.mu.Lock()
+	call := cli.pending[h.Seq]
+	cli.mu.Unlock()
+	if call == nil || call.stream == nil {
+		return cli.c.ReadBody(nil)
+	}
+	var msg codec.RawMessage
+	if err := cli.c.ReadBody(&msg); err != nil {
+		if st, ok := status.FromError(err); ok {
+			// 分帧协议已经跳过了这条消息，只结束这个流
+			call.stream.abort(st)
+			return nil
+		}
+		return err
+	}
+	select {
+	case call.stream.msgs <- msg:
+	default:
+		call.stream.abort(status.New(status.ResourceExhausted, "rpc client: server ignored the stream window"))
+	}
+	return nil
+}
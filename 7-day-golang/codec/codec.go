@@ -1,12 +1,52 @@
 package codec
-import "io"
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
 
 type Header struct{
 	ServiceMethod string  `json:"ServiceMethod"`//"调用方法 格式 service.method"
 	Seq uint64   `json:"Seq"`//客户端选择的序列号
 	Error string `json:"Error"`
+	Code uint32 `json:"Code,omitempty"` // 错误码，见 status 包；老的服务端只会填 Error
+	Details map[string]string `json:"Details,omitempty"` // 错误的附加信息
+	Kind MsgKind `json:"Kind,omitempty"` // 帧类型，零值为普通请求/回复，老的 codec 数据不受影响
+	Timeout time.Duration `json:"Timeout,omitempty"` // 调用方剩余的时间预算，0 表示没有截止时间
+	Meta map[string]string `json:"Meta,omitempty"` // 请求或回复的元数据，见 metadata 包
+	Credit uint32 `json:"Credit,omitempty"` // 流控窗口，只在 KindStreamOpen 和 KindWindowUpdate 里使用
  }
 
+// MsgKind 标识一帧的用途
+type MsgKind uint8
+
+const (
+	KindRequest MsgKind = iota // 普通请求或回复
+	// KindCancel 由客户端发送，取消同一连接上序列号为 Seq 的请求。
+	// ServiceMethod 为空，老版本服务端会当作非法请求回复一个错误，客户端直接丢弃。
+	KindCancel
+	// KindStreamOpen 打开一个流式调用，Credit 是客户端的接收窗口。流的最后一个回复是普通的回复，带着最终的错误
+	KindStreamOpen
+	// KindStreamMsg 是流里的一条消息，Seq 和打开流的请求相同，两个方向都使用
+	KindStreamMsg
+	// KindWindowUpdate 表示接收方又处理完了 Credit 条消息，发送方可以继续发送，body 是空的占位
+	KindWindowUpdate
+	// KindCloseSend 由客户端发送，表示这个流不会再有客户端的消息了
+	KindCloseSend
+	// KindOneWay 是不需要回复的请求，服务端处理完或者出错都不会回复。
+	// 老版本服务端会当作普通请求回复，客户端找不到对应的调用直接丢弃
+	KindOneWay
+)
+
+// DefaultStreamWindow 是流的默认接收窗口，发送方最多发出这么多条没有被确认的消息。
+// 服务端的接收窗口固定是这个值，客户端的接收窗口在 KindStreamOpen 里告诉服务端
+const DefaultStreamWindow = 32
+
+// RawMessage 是还没有解码的 body，ReadBody 传入 *RawMessage 时只读出原始字节。
+// 只有分帧协议支持，流式调用用它把解码推迟到调用方读取消息的时候
+type RawMessage []byte
+
 //编码器是一个接口，需要实现:关闭数据流，读，写等方法
 
 type Codec interface{
@@ -17,6 +57,33 @@ type Codec interface{
 
 }
 
+// Flusher 是需要知道消息边界的连接，比如压缩的连接，每条消息写完后要调用 Flush
+type Flusher interface {
+	Flush() error
+}
+
+// FlushWrites 在 conn 是 Flusher 时包装 c，每次 Write 之后调用 conn 的 Flush，否则原样返回 c。
+// 用 Register 注册的 codec 不知道 conn 的消息边界，老协议用它包装
+func FlushWrites(c Codec, conn io.Writer) Codec {
+	f, ok := conn.(Flusher)
+	if !ok {
+		return c
+	}
+	return &flushCodec{Codec: c, f: f}
+}
+
+type flushCodec struct {
+	Codec
+	f Flusher
+}
+
+func (c *flushCodec) Write(h *Header, body interface{}) error {
+	if err := c.Codec.Write(h, body); err != nil {
+		return err
+	}
+	return c.f.Flush()
+}
+
 //codec 的构造函数,传入一个io.readwritecloser 实例，返回一个codec实例
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 
@@ -26,12 +93,60 @@ type Type string
 const (
 	GobType  Type = "application/gob"
 	JsonType Type = "application/json" // not implemented
+	ProtobufType Type = "application/protobuf" // args 和 reply 需要是 proto.Message
+	MsgpackType Type = "application/msgpack"
 )
 
+// NewCodecFuncMap 只包含内置的编解码器，保留给老代码读取。
+// Deprecated: 并发不安全，也看不到通过 Register 注册的编解码器，请使用 Get
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+var (
+	mu       sync.RWMutex // protect following
+	registry = make(map[Type]NewCodecFunc)
+)
+
+// Register 注册一种编解码器，可以在运行时并发调用，同一个 Type 重复注册会覆盖
+func Register(t Type, f NewCodecFunc) {
+	if f == nil {
+		panic("rpc codec: Register codec is nil")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	registry[t] = f
+}
+
+// Get returns the NewCodecFunc registered for t
+func Get(t Type) (NewCodecFunc, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := registry[t]
+	return f, ok
+}
+
+// Types returns all registered codec types in sorted order
+func Types() []Type {
+	mu.RLock()
+	defer mu.RUnlock()
+	types := make([]Type, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 func init(){
 	NewCodecFuncMap = make(map[Type]NewCodecFunc) //string-func 的map
 	NewCodecFuncMap[GobType] = NewGobCodec //新建一个Gob编码器
 	NewCodecFuncMap[JsonType] = NewJsonCodec //新建一个Json编码器
-}
\ No newline at end of file
+	NewCodecFuncMap[ProtobufType] = NewProtobufCodec
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
+	for t, f := range NewCodecFuncMap {
+		Register(t, f)
+	}
+	RegisterMarshaler(GobType, gobMarshaler{})
+	RegisterMarshaler(JsonType, jsonMarshaler{})
+	RegisterMarshaler(ProtobufType, protobufMarshaler{})
+	RegisterMarshaler(MsgpackType, msgpackMarshaler{})
+}
@@ -0,0 +1,59 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+type nopCloser struct{ io.ReadWriter }
+
+func (nopCloser) Close() error { return nil }
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestProtobufCodec_MaxFrameSize(t *testing.T) {
+	for _, n := range []uint64{1 << 62, DefaultMaxMessageSize + 1} {
+		var buf bytes.Buffer
+		var size [binary.MaxVarintLen64]byte
+		buf.Write(size[:binary.PutUvarint(size[:], n)])
+		c := NewProtobufCodec(nopCloser{&buf})
+		var h Header
+		err := c.ReadHeader(&h)
+		_assert(err != nil && strings.Contains(err.Error(), "exceeds limit"), "expect frame size %d to be rejected, but got %v", n, err)
+	}
+
+	// 正常大小的帧不受影响
+	var buf bytes.Buffer
+	c := NewProtobufCodec(nopCloser{&buf})
+	_assert(c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, nil) == nil, "write failed")
+	var h Header
+	err := c.ReadHeader(&h)
+	_assert(err == nil && h.ServiceMethod == "Foo.Sum" && h.Seq == 1, "expect the header to round trip, but got %+v (%v)", h, err)
+}
+
+func TestFrameCodec_MaxHandshakeSize(t *testing.T) {
+	var buf bytes.Buffer
+	var p [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(p[0:4], FrameMagic)
+	p[4], p[5] = FrameVersion, FlagHandshake
+	binary.BigEndian.PutUint32(p[10:14], 0xFFFFFFF0)
+	buf.Write(p[:])
+	c := NewFrameCodec(nopCloser{&buf}, nil, 0)
+	var v map[string]interface{}
+	err := c.ReadHandshake(&v)
+	_assert(err != nil && strings.Contains(err.Error(), "exceeds limit"), "expect the handshake body to be rejected, but got %v", err)
+
+	buf.Reset()
+	c = NewFrameCodec(nopCloser{&buf}, nil, 0)
+	_assert(c.WriteHandshake(map[string]string{"CodecType": "application/gob"}) == nil, "write failed")
+	err = c.ReadHandshake(&v)
+	_assert(err == nil && v["CodecType"] == "application/gob", "expect the handshake to round trip, but got %v (%v)", v, err)
+}
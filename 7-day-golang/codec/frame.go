@@ -0,0 +1,229 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geerpc/status"
+	"io"
+	"log"
+)
+
+// 分帧协议每条消息的格式如下，整数都是大端序:
+// | magic 4 字节 | version 1 字节 | flags 1 字节 | header 长度 4 字节 | body 长度 4 字节 | header | body |
+// header 固定用 protobuf 编码（见 marshalHeader），body 用协商好的 Marshaler 编码。
+// 连接建立后客户端先发一个握手帧，body 是 JSON 编码的 Option，服务端回一个握手帧表示接受或拒绝
+const (
+	FrameMagic   uint32 = 0x003bef5c // 第一个字节是 0，和老协议 Option 的 '{' 区分开
+	FrameVersion uint8  = 2          // 老的 JSON Option + 流式编码协议算作版本 1
+
+	frameHeaderLen = 14
+	// DefaultMaxMessageSize 是 header 或 body 的默认最大长度
+	DefaultMaxMessageSize = 16 << 20
+	// MaxHandshakeSize 是握手帧 header 加 body 的最大长度，握手在认证之前，不能让对端分配大块内存
+	MaxHandshakeSize = 64 << 10
+)
+
+const (
+	FlagHandshake uint8 = 1 << iota // 握手帧，body 是 JSON
+)
+
+var ErrBadMagic = errors.New("rpc codec: bad frame magic, protocol mismatch")
+
+// FrameCodec 实现了分帧协议，所有 body 错误都以 *status.Status 返回，
+// 这时这一帧已经完整读掉了，连接还可以继续使用
+type FrameCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	m    Marshaler
+	max  uint32
+
+	bodyLen uint32 // ReadHeader 之后还没读的 body 长度
+}
+
+// NewFrameCodec 创建分帧的 codec，m 可以在握手之后再通过 SetMarshaler 设置，
+// maxSize <= 0 时使用 DefaultMaxMessageSize
+func NewFrameCodec(conn io.ReadWriteCloser, m Marshaler, maxSize int) *FrameCodec {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &FrameCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		m:    m,
+		max:  uint32(maxSize),
+	}
+}
+
+var _ Codec = (*FrameCodec)(nil)
+
+// SetMarshaler 设置 body 的编码方式，服务端在读完握手帧后调用
+func (c *FrameCodec) SetMarshaler(m Marshaler) {
+	c.m = m
+}
+
+// Marshaler returns the Marshaler used to encode bodies
+func (c *FrameCodec) Marshaler() Marshaler {
+	return c.m
+}
+
+func (c *FrameCodec) ReadHeader(h *Header) error {
+	flags, hlen, blen, err := c.readPrefix()
+	if err != nil {
+		return err
+	}
+	if flags&FlagHandshake != 0 {
+		return errors.New("rpc codec: unexpected handshake frame")
+	}
+	b, err := c.readN(hlen)
+	if err != nil {
+		return err
+	}
+	c.bodyLen = blen
+	return unmarshalHeader(b, h)
+}
+
+func (c *FrameCodec) ReadBody(body interface{}) error {
+	n := c.bodyLen
+	c.bodyLen = 0
+	if n > c.max || body == nil {
+		// 太大的 body 或者不需要的 body 直接丢掉，不影响后面的消息
+		if _, err := c.r.Discard(int(n)); err != nil {
+			return err
+		}
+		if n > c.max {
+			return status.Errorf(status.ResourceExhausted, "rpc codec: message size %d exceeds limit %d", n, c.max)
+		}
+		return nil
+	}
+	b, err := c.readN(n)
+	if err != nil {
+		return err
+	}
+	if raw, ok := body.(*RawMessage); ok {
+		*raw = b
+		return nil
+	}
+	if err = c.m.Unmarshal(b, body); err != nil {
+		return status.Errorf(status.InvalidArgument, "rpc codec: can't decode body: %v", err)
+	}
+	return nil
+}
+
+func (c *FrameCodec) Write(h *Header, body interface{}) error {
+	b, err := c.m.Marshal(body)
+	if err != nil {
+		log.Println("rpc codec: frame error encoding body:", err)
+		return status.Errorf(status.Internal, "rpc codec: can't encode body: %v", err)
+	}
+	if uint64(len(b)) > uint64(c.max) {
+		// 什么都没写，连接还可以用
+		return status.Errorf(status.ResourceExhausted, "rpc codec: message size %d exceeds limit %d", len(b), c.max)
+	}
+	return c.writeFrame(0, marshalHeader(h), b)
+}
+
+// WriteHandshake 写一个握手帧，v 用 JSON 编码
+func (c *FrameCodec) WriteHandshake(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(FlagHandshake, nil, b)
+}
+
+// ReadHandshake 读一个握手帧到 v，版本不对时返回 *VersionError
+func (c *FrameCodec) ReadHandshake(v interface{}) error {
+	flags, hlen, blen, err := c.readPrefix()
+	if err != nil {
+		return err
+	}
+	if flags&FlagHandshake == 0 {
+		return errors.New("rpc codec: expect a handshake frame")
+	}
+	if uint64(hlen)+uint64(blen) > MaxHandshakeSize {
+		return fmt.Errorf("rpc codec: handshake size %d exceeds limit %d", uint64(hlen)+uint64(blen), MaxHandshakeSize)
+	}
+	if _, err = c.readN(hlen); err != nil {
+		return err
+	}
+	b, err := c.readN(blen)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c *FrameCodec) Close() error {
+	return c.conn.Close()
+}
+
+// VersionError 表示对端使用了不支持的协议版本
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("rpc codec: unsupported protocol version %d, expect %d", e.Version, FrameVersion)
+}
+
+func (c *FrameCodec) readPrefix() (flags uint8, hlen, blen uint32, err error) {
+	var p [frameHeaderLen]byte
+	if _, err = io.ReadFull(c.r, p[:]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(p[0:4]) != FrameMagic {
+		err = ErrBadMagic
+		return
+	}
+	if p[4] != FrameVersion {
+		err = &VersionError{Version: p[4]}
+		return
+	}
+	flags = p[5]
+	hlen = binary.BigEndian.Uint32(p[6:10])
+	blen = binary.BigEndian.Uint32(p[10:14])
+	if hlen > c.max {
+		// header 太大没法跳过后再回复，只能断开
+		err = fmt.Errorf("rpc codec: header size %d exceeds limit %d", hlen, c.max)
+	}
+	return
+}
+
+func (c *FrameCodec) readN(n uint32) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(c.r, b)
+	return b, err
+}
+
+func (c *FrameCodec) writeFrame(flags uint8, header, body []byte) (err error) {
+	defer func() {
+		if err == nil {
+			err = c.w.Flush()
+		}
+		if f, ok := c.conn.(Flusher); ok && err == nil {
+			err = f.Flush() // 一帧是一条消息
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	var p [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(p[0:4], FrameMagic)
+	p[4] = FrameVersion
+	p[5] = flags
+	binary.BigEndian.PutUint32(p[6:10], uint32(len(header)))
+	binary.BigEndian.PutUint32(p[10:14], uint32(len(body)))
+	if _, err = c.w.Write(p[:]); err != nil {
+		return err
+	}
+	if _, err = c.w.Write(header); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
@@ -32,6 +32,11 @@ func (c * JsonCodec) ReadHeader(h *Header) error {
 	 return err
 }
 func (c *JsonCodec) ReadBody(body interface{}) error{
+	if body == nil {
+		// 和 gob 一样，body 为 nil 时丢弃这一段数据
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
 	return c.dec.Decode(body)
 }
 func (c * JsonCodec) Write(h *Header,body interface{}) (err error){
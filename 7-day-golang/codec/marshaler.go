@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Marshaler 把单个值编解码成一段独立的字节，分帧协议用它编码 body。
+// 每一段都能单独解码，服务端跳过某个 body 不会影响后面的请求
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var marshalers = make(map[Type]Marshaler) // protected by mu
+
+// RegisterMarshaler 为 t 注册分帧协议使用的 Marshaler，没有注册的编解码器只能走老协议
+func RegisterMarshaler(t Type, m Marshaler) {
+	if m == nil {
+		panic("rpc codec: RegisterMarshaler marshaler is nil")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	marshalers[t] = m
+}
+
+// GetMarshaler returns the Marshaler registered for t
+func GetMarshaler(t Type) (Marshaler, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	m, ok := marshalers[t]
+	return m, ok
+}
+
+// gob 的类型信息跟着 encoder 走，每个值用新的 encoder 保证可以单独解码
+type gobMarshaler struct{}
+
+func (gobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonMarshaler) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type protobufMarshaler struct{}
+
+func (protobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+	if v == nil || v == (struct{}{}) {
+		return nil, nil // 出错时的占位 body
+	}
+	return nil, errNotProtoMessage
+}
+
+func (protobufMarshaler) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errNotProtoMessage
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+type msgpackMarshaler struct{}
+
+func (msgpackMarshaler) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackMarshaler) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
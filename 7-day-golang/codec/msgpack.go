@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec 和 gob 一样是流式编码，但格式跨语言。
+// Header 编码成以字段名为 key 的 map，非 Go 客户端按 Header 的字段名读写即可
+type MsgpackCodec struct {
+	conn io.ReadWriteCloser
+	enc  *msgpack.Encoder
+	dec  *msgpack.Decoder
+	buf  *bufio.Writer
+}
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buff := bufio.NewWriter(conn)
+	enc := msgpack.NewEncoder(buff) //编码到buff里
+	enc.SetOmitEmpty(true)          // header 大部分字段是零值，不用写
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buff,
+		enc:  enc,
+		dec:  msgpack.NewDecoder(bufio.NewReader(conn)), //从conn解码
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	*h = Header{} // 省略的字段不会被覆盖，要先清零
+	return c.dec.Decode(h)
+}
+
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return c.dec.Skip()
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) (err error) {
+	// 写完要从buf里flush到io然后关闭
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: msgpack error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,275 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec 每一帧的格式如下，长度都是 uvarint:
+// | header 长度 | header(protobuf 编码) | body 长度 | body(proto.Message) |
+// args 和 reply 必须实现 proto.Message，这样可以和其他技术栈共用 .proto 定义的消息
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	buf  *bufio.Writer
+	max  uint64 // 一帧的最大长度，超过时不分配内存直接报错
+}
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		buf:  bufio.NewWriter(conn),
+		max:  DefaultMaxMessageSize,
+	}
+}
+
+var errNotProtoMessage = errors.New("rpc codec: protobuf body must be a proto.Message")
+
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	b, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(b, h)
+}
+
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	b, err := c.readFrame()
+	if err != nil || body == nil {
+		return err
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return errNotProtoMessage
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+func (c *ProtobufCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	var b []byte
+	if msg, ok := body.(proto.Message); ok {
+		if b, err = proto.Marshal(msg); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return err
+		}
+	} else if body != nil && body != (struct{}{}) {
+		// 出错时的占位 body 和取消帧的 body 是空结构体，写一个空帧即可
+		log.Println("rpc codec: protobuf error encoding body:", errNotProtoMessage)
+		return errNotProtoMessage
+	}
+	if err = c.writeFrame(marshalHeader(h)); err != nil {
+		log.Println("rpc codec: protobuf error encoding header:", err)
+		return err
+	}
+	if err = c.writeFrame(b); err != nil {
+		log.Println("rpc codec: protobuf error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ProtobufCodec) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > c.max {
+		// 长度不可信，后面的数据也没法再分帧，只能断开
+		return nil, fmt.Errorf("rpc codec: protobuf frame size %d exceeds limit %d", n, c.max)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *ProtobufCodec) writeFrame(b []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	if _, err := c.buf.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	_, err := c.buf.Write(b)
+	return err
+}
+
+// Header 的 protobuf 字段号，新增字段只能往后加
+const (
+	fieldServiceMethod protowire.Number = iota + 1
+	fieldSeq
+	fieldError
+	fieldKind
+	fieldTimeout
+	fieldMeta
+	fieldCode
+	fieldDetails
+	fieldCredit
+)
+
+// marshalHeader 手写 Header 的 protobuf 编码，分帧协议也用它编码 header，等价于
+//
+//	message Header {
+//	  string service_method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  uint32 kind = 4;
+//	  int64 timeout = 5;
+//	  map<string, string> meta = 6;
+//	  uint32 code = 7;
+//	  map<string, string> details = 8;
+//	  uint32 credit = 9;
+//	}
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, fieldServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, fieldSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, fieldError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Kind != 0 {
+		b = protowire.AppendTag(b, fieldKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, fieldTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	b = appendMap(b, fieldMeta, h.Meta)
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, fieldCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	b = appendMap(b, fieldDetails, h.Details)
+	if h.Credit != 0 {
+		b = protowire.AppendTag(b, fieldCredit, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Credit))
+	}
+	return b
+}
+
+// appendMap 按 protobuf map 的格式编码，每一项是一个 {1: key, 2: value} 的子消息
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == fieldSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == fieldError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == fieldKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Kind = MsgKind(v)
+		case num == fieldTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case (num == fieldMeta || num == fieldDetails) && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(b)
+			if n < 0 {
+				break
+			}
+			k, v, err := unmarshalMapEntry(entry)
+			if err != nil {
+				return err
+			}
+			if num == fieldMeta {
+				if h.Meta == nil {
+					h.Meta = make(map[string]string)
+				}
+				h.Meta[k] = v
+			} else {
+				if h.Details == nil {
+					h.Details = make(map[string]string)
+				}
+				h.Details[k] = v
+			}
+		case num == fieldCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == fieldCredit && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Credit = uint32(v)
+		default:
+			// 不认识的字段直接跳过，兼容以后新增的字段
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalMapEntry(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", fmt.Errorf("rpc codec: bad map entry: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
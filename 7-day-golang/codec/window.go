@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrWindowClosed = errors.New("rpc codec: stream window is closed")
+
+// Window 是流式调用发送方的流控窗口，credit 是还能发送的消息数。
+// 接收方每处理完一批消息就回一个 KindWindowUpdate，发送方用 Add 增加窗口
+type Window struct {
+	mu     sync.Mutex
+	credit int
+	closed bool
+	notify chan struct{}
+}
+
+func NewWindow(credit int) *Window {
+	return &Window{credit: credit, notify: make(chan struct{}, 1)}
+}
+
+// Add 增加 n 个窗口
+func (w *Window) Add(n int) {
+	w.mu.Lock()
+	w.credit += n
+	w.mu.Unlock()
+	w.wake()
+}
+
+// Close 在流结束时调用，之后 Take 都返回 ErrWindowClosed
+func (w *Window) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.wake()
+}
+
+// Take 占用一个窗口，窗口用完时等待接收方确认、ctx 结束或者窗口关闭
+func (w *Window) Take(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			w.wake() // 可能还有别的 goroutine 在等
+			return ErrWindowClosed
+		}
+		if w.credit > 0 {
+			w.credit--
+			more := w.credit > 0
+			w.mu.Unlock()
+			if more {
+				w.wake()
+			}
+			return nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (w *Window) wake() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
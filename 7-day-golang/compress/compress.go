@@ -0,0 +1,122 @@
+// Package compress 提供连接级别的压缩，包在 codec 下面的连接上，所以对任何 codec.Codec 都有效。
+// 压缩算法由客户端在 service.Option 里选择，服务端不支持时握手失败
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// 内置的压缩算法。zstd 的实现需要更高的 go 版本，暂时没有内置，需要时可以自己 Register
+const (
+	Gzip   = "gzip"
+	Snappy = "snappy"
+)
+
+// Compressor 压缩和解压一个完整的块，rawLen 是解压后的长度，实现时不能分配超过它的内存
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte, rawLen int) ([]byte, error)
+}
+
+var (
+	mu          sync.RWMutex // protect following
+	compressors = make(map[string]Compressor)
+)
+
+// Register 注册一种压缩算法，同名的会被覆盖
+func Register(c Compressor) {
+	if c == nil {
+		panic("rpc compress: Register compressor is nil")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// Get returns the Compressor registered with name
+func Get(name string) (Compressor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+// Names returns all registered compressor names in sorted order
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register(gzipCompressor{})
+	Register(snappyCompressor{})
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return Gzip }
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte, rawLen int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, rawLen)
+	if _, err = io.ReadFull(r, dst); err != nil {
+		return nil, err
+	}
+	// 多出来的数据说明块头里的长度不对
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, fmt.Errorf("rpc compress: gzip block longer than %d bytes", rawLen)
+	}
+	return dst, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return Snappy }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte, rawLen int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n != rawLen {
+		return nil, fmt.Errorf("rpc compress: snappy block is %d bytes, expect %d", n, rawLen)
+	}
+	return snappy.Decode(make([]byte, n), src)
+}
@@ -0,0 +1,167 @@
+package compress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Conn 把一条消息作为一个或多个块发送，整数都是大端序:
+// | flags 1 字节 | 原始长度 4 字节 | 数据长度 4 字节 | 数据 |
+// Write 先缓存，Flush 表示一条消息写完了，小于 minSize 的消息不会被压缩，压缩后没有变小的块也原样发送。
+// codec 每条消息写完后要调用 Flush，codec.FlushWrites 会替 codec 调用
+type Conn struct {
+	io.ReadWriteCloser
+	c       Compressor
+	minSize int
+	stats   *Stats
+
+	pending []byte // 已经解压还没被读走的数据
+	wbuf    []byte // 当前消息还没发出去的数据
+	msgLen  int    // 当前消息一共写了多少，决定是否压缩
+}
+
+const (
+	// DefaultMinSize 是默认的压缩阈值
+	DefaultMinSize = 1 << 10
+	// MaxBlockSize 是一个块解压后的最大长度，更大的 Write 会被拆开，也防止对端用很小的数据解压出很大的内存
+	MaxBlockSize = 1 << 20
+
+	blockHeaderLen = 9
+	flagCompressed = 1
+)
+
+// NewConn 用 c 压缩 conn 上的数据，minSize <= 0 时使用 DefaultMinSize，stats 可以为 nil
+func NewConn(conn io.ReadWriteCloser, c Compressor, minSize int, stats *Stats) *Conn {
+	if minSize <= 0 {
+		minSize = DefaultMinSize
+	}
+	if minSize > MaxBlockSize {
+		minSize = MaxBlockSize // 消息写满一个块时还不知道它最后有多大
+	}
+	if stats == nil {
+		stats = new(Stats)
+	}
+	return &Conn{ReadWriteCloser: conn, c: c, minSize: minSize, stats: stats}
+}
+
+// Stats returns the byte counters of the connection
+func (c *Conn) Stats() *Stats {
+	return c.stats
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readBlock() error {
+	var h [blockHeaderLen]byte
+	if _, err := io.ReadFull(c.ReadWriteCloser, h[:]); err != nil {
+		return err
+	}
+	flags := h[0]
+	rawLen := binary.BigEndian.Uint32(h[1:5])
+	dataLen := binary.BigEndian.Uint32(h[5:9])
+	if flags&^flagCompressed != 0 || rawLen > MaxBlockSize || dataLen > 2*MaxBlockSize {
+		return fmt.Errorf("rpc compress: bad block header flags=%d raw=%d data=%d", flags, rawLen, dataLen)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(c.ReadWriteCloser, data); err != nil {
+		return err
+	}
+	if flags&flagCompressed != 0 {
+		var err error
+		if data, err = c.c.Decompress(data, int(rawLen)); err != nil {
+			return fmt.Errorf("rpc compress: %s decompress error: %w", c.c.Name(), err)
+		}
+		atomic.AddUint64(&c.stats.CompressedBlocksReceived, 1)
+	} else if dataLen != rawLen {
+		return fmt.Errorf("rpc compress: bad block header raw=%d data=%d", rawLen, dataLen)
+	}
+	atomic.AddUint64(&c.stats.BytesReceived, uint64(rawLen))
+	atomic.AddUint64(&c.stats.WireBytesReceived, uint64(blockHeaderLen+dataLen))
+	c.pending = data
+	return nil
+}
+
+// Write 把 p 加到当前消息里，攒够 MaxBlockSize 就先发一个块
+func (c *Conn) Write(p []byte) (int, error) {
+	c.msgLen += len(p)
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= MaxBlockSize {
+		if err := c.writeBlock(c.wbuf[:MaxBlockSize]); err != nil {
+			return 0, err
+		}
+		c.wbuf = append(c.wbuf[:0], c.wbuf[MaxBlockSize:]...)
+	}
+	return len(p), nil
+}
+
+// Flush 发出当前消息剩下的数据，消息的总长度不小于 minSize 时压缩
+func (c *Conn) Flush() error {
+	defer func() { c.wbuf, c.msgLen = c.wbuf[:0], 0 }()
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	return c.writeBlock(c.wbuf)
+}
+
+func (c *Conn) writeBlock(raw []byte) error {
+	var flags uint8
+	data := raw
+	if c.msgLen >= c.minSize {
+		b, err := c.c.Compress(raw)
+		if err != nil {
+			return fmt.Errorf("rpc compress: %s compress error: %w", c.c.Name(), err)
+		}
+		if len(b) < len(raw) {
+			flags, data = flagCompressed, b
+		}
+	}
+	// 块头和数据一次写出去
+	buf := make([]byte, blockHeaderLen+len(data))
+	buf[0] = flags
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(raw)))
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(data)))
+	copy(buf[blockHeaderLen:], data)
+	if _, err := c.ReadWriteCloser.Write(buf); err != nil {
+		return err
+	}
+	if flags != 0 {
+		atomic.AddUint64(&c.stats.CompressedBlocksSent, 1)
+	}
+	atomic.AddUint64(&c.stats.BytesSent, uint64(len(raw)))
+	atomic.AddUint64(&c.stats.WireBytesSent, uint64(len(buf)))
+	return nil
+}
+
+// Stats 记录压缩前后的字节数，用于排查压缩是否生效，字段用 atomic 读写。
+// Bytes 是压缩前(或解压后)的字节数，WireBytes 是连接上实际传输的字节数，包括块头
+type Stats struct {
+	BytesSent                uint64
+	WireBytesSent            uint64
+	CompressedBlocksSent     uint64 // 小于阈值或压缩后没有变小的块不算
+	BytesReceived            uint64
+	WireBytesReceived        uint64
+	CompressedBlocksReceived uint64
+}
+
+// Snapshot 原子地读出所有计数
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		BytesSent:                atomic.LoadUint64(&s.BytesSent),
+		WireBytesSent:            atomic.LoadUint64(&s.WireBytesSent),
+		CompressedBlocksSent:     atomic.LoadUint64(&s.CompressedBlocksSent),
+		BytesReceived:            atomic.LoadUint64(&s.BytesReceived),
+		WireBytesReceived:        atomic.LoadUint64(&s.WireBytesReceived),
+		CompressedBlocksReceived: atomic.LoadUint64(&s.CompressedBlocksReceived),
+	}
+}
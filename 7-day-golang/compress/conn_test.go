@@ -0,0 +1,49 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type nopCloser struct{ io.ReadWriter }
+
+func (nopCloser) Close() error { return nil }
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestConn_Threshold(t *testing.T) {
+	var wire bytes.Buffer
+	cp, _ := Get(Gzip)
+	c := NewConn(nopCloser{&wire}, cp, 2048, nil)
+
+	// 一条消息分几次写，每次都小于阈值，整条消息超过阈值就压缩
+	msg := bytes.Repeat([]byte("geerpc "), 500)
+	for p := msg; len(p) > 0; p = p[1000:] {
+		if len(p) < 1000 {
+			_, _ = c.Write(p)
+			break
+		}
+		_, _ = c.Write(p[:1000])
+	}
+	_assert(wire.Len() == 0, "expect writes to be buffered until Flush, but got %d bytes", wire.Len())
+	_assert(c.Flush() == nil, "flush failed")
+	stats := c.Stats().Snapshot()
+	_assert(stats.CompressedBlocksSent == 1 && stats.BytesSent == uint64(len(msg)), "expect one compressed block, but got %+v", stats)
+
+	// 小消息不压缩
+	_, _ = c.Write([]byte("small"))
+	_ = c.Flush()
+	stats = c.Stats().Snapshot()
+	_assert(stats.CompressedBlocksSent == 1, "expect small messages not to be compressed, but got %+v", stats)
+
+	r := NewConn(nopCloser{&wire}, cp, 0, nil)
+	got, _ := ioutil.ReadAll(r)
+	_assert(bytes.Equal(got, append(msg, "small"...)), "expect the data to round trip")
+}
@@ -1,3 +1,11 @@
 module geerpc
 
 go 1.17
+
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.33.0
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,140 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MD 是随请求/回复一起传输的元数据，例如 trace id、token、租户 id
+type MD map[string]string
+
+// Pairs 用 key, value, key, value... 的形式创建 MD
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic(fmt.Sprintf("metadata: Pairs got the odd number of input pairs for metadata: %d", len(kv)))
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Get returns the value of key, "" if not present
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+// Set sets the value of key
+func (md MD) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy returns a copy of md
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// Join 合并多个 MD，后面的覆盖前面的
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type (
+	outgoingKey struct{} // 客户端要发出去的请求元数据
+	incomingKey struct{} // 服务端收到的请求元数据
+	sendKey     struct{} // 服务端 handler 要回复的元数据
+	recvKey     struct{} // 客户端收到的回复元数据
+)
+
+// NewOutgoingContext 把 md 附加到 ctx 上，用这个 ctx 发起的调用会带上 md
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在 ctx 已有的请求元数据上追加 kv
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext returns the outgoing metadata in ctx if it exists
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext 由服务端调用，把收到的 md 附加到请求的 ctx 上，
+// 同时准备好 handler 通过 SetResponse 写回复元数据的位置
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	if md == nil {
+		md = MD{}
+	}
+	ctx = context.WithValue(ctx, incomingKey{}, md)
+	return context.WithValue(ctx, sendKey{}, &holder{})
+}
+
+// FromIncomingContext returns the incoming metadata in ctx if it exists
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+var ErrNotServerContext = errors.New("metadata: ctx is not a server request context")
+
+// SetResponse 由 handler 调用，md 会随回复发回给客户端，多次调用会合并
+func SetResponse(ctx context.Context, md MD) error {
+	h, ok := ctx.Value(sendKey{}).(*holder)
+	if !ok {
+		return ErrNotServerContext
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.md = Join(h.md, md)
+	return nil
+}
+
+// ResponseFromIncomingContext 由服务端调用，取出 handler 设置的回复元数据
+func ResponseFromIncomingContext(ctx context.Context) MD {
+	h, ok := ctx.Value(sendKey{}).(*holder)
+	if !ok {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.md
+}
+
+// WithResponse 由客户端调用，调用结束后服务端回复的元数据会写到 md 里
+func WithResponse(ctx context.Context, md *MD) context.Context {
+	return context.WithValue(ctx, recvKey{}, &holder{dst: md})
+}
+
+// DeliverResponse 由客户端在收到回复时调用，把 md 交给 WithResponse 的调用方
+func DeliverResponse(ctx context.Context, md MD) {
+	h, ok := ctx.Value(recvKey{}).(*holder)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.dst = md
+}
+
+type holder struct {
+	mu  sync.Mutex // Broadcast 时多个回复会同时写
+	md  MD
+	dst *MD
+}
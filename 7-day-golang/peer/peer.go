@@ -0,0 +1,44 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Peer 描述连接的另一端，服务端把它放进每个请求的 context
+type Peer struct {
+	Addr net.Addr             // 对端地址，不是 net.Conn 的连接为 nil
+	TLS  *tls.ConnectionState // 明文连接为 nil
+}
+
+// Identity 返回验证过的客户端证书里的身份，优先用 CommonName，没有时用第一个 DNS 或 URI SAN。
+// 没有开启客户端证书验证时返回 ""
+func (p *Peer) Identity() string {
+	if p == nil || p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := p.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+type peerKey struct{}
+
+// NewContext returns a copy of ctx carrying p
+func NewContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// FromContext returns the Peer in ctx
+func FromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,8 +20,9 @@ type Registry struct {
 }
 
 type ServerItem struct {
-	Addr  string
-	start time.Time
+	Addr   string
+	Weight int // 心跳里带的权重，没有时为 1
+	start  time.Time
 }
 
 const (
@@ -38,29 +40,33 @@ func New(timeout time.Duration) *Registry {
 
 var DefaultRegister = New(defaultTimeout)
 // 注册中心的主要功能为注册服务和发送心跳
-func (r *Registry) putServer(addr string) {
+func (r *Registry) putServer(addr string, weight int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if weight <= 0 {
+		weight = 1
+	}
 	s := r.servers[addr]
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+		r.servers[addr] = &ServerItem{Addr: addr, Weight: weight, start: time.Now()}
 	} else {
 		s.start = time.Now() // if exists, update start time to keep alive
+		s.Weight = weight
 	}
 }
 
-func (r *Registry) aliveServers() []string {
+func (r *Registry) aliveServers() []*ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
+	var alive []*ServerItem
 	for addr, s := range r.servers { //遍历所有服务
 		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) { //未超时
-			alive = append(alive, addr)
+			alive = append(alive, &ServerItem{Addr: s.Addr, Weight: s.Weight})
 		} else {
 			delete(r.servers, addr) //超时删除
 		}
 	}
-	sort.Strings(alive)
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
 	return alive
 }
 
@@ -70,7 +76,13 @@ func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ",")) //返回存活服务
+		alive := r.aliveServers()
+		addrs, weights := make([]string, len(alive)), make([]string, len(alive))
+		for i, s := range alive {
+			addrs[i], weights[i] = s.Addr, strconv.Itoa(s.Weight)
+		}
+		w.Header().Set("X-Geerpc-Servers", strings.Join(addrs, ",")) //返回存活服务
+		w.Header().Set("X-Geerpc-Weights", strings.Join(weights, ",")) // 和上面的地址一一对应
 	case "POST":
 		// keep it simple, server is in req.Header
 		addr := req.Header.Get("X-Geerpc-Server")
@@ -78,7 +90,8 @@ func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)// 注册服务
+		weight, _ := strconv.Atoi(req.Header.Get("X-Geerpc-Weight")) // 老的服务端不带权重
+		r.putServer(addr, weight)// 注册服务
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -98,27 +111,35 @@ func HandleHTTP() {
 // Heartbeat send a heartbeat message every once in a while
 // it's a helper function for a server to register or send heartbeat
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatWeight(registry, addr, 0, duration)
+}
+
+// HeartbeatWeight 和 Heartbeat 一样，同时告诉注册中心这个服务端的权重，用于 xclient 的加权轮询
+func HeartbeatWeight(registry, addr string, weight int, duration time.Duration) {
 	if duration == 0 {
 		// make sure there is enough time to send heart beat
 		// before it's removed from registry
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(registry, addr, weight)
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(registry, addr, weight)
 		}
 	}()
 }
 
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(registry, addr string, weight int) error {
 	log.Println(addr, "send heart beat to registry", registry)// 向注册中心发送心跳
 	httpClient := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-Geerpc-Server", addr)
+	if weight > 0 {
+		req.Header.Set("X-Geerpc-Weight", strconv.Itoa(weight))
+	}
 	if _, err := httpClient.Do(req); err != nil {
 		log.Println("rpc server: heart beat err:", err)
 		return err
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// PingMethod 是每个服务端都有的健康检查方法，不需要注册，也不受授权规则限制。
+// 参数和回复都是 struct{}，body 是每个编解码器都认识的空占位，服务端能处理请求时返回 nil
+const PingMethod = "Geerpc.Ping"
+
+// health 是服务端内置的服务，名字在 PingMethod 里
+type health struct{}
+
+func (health) Ping(ctx context.Context, args struct{}, reply *struct{}) error {
+	return ctx.Err()
+}
+
+var (
+	builtinOnce    sync.Once
+	builtinService *service
+)
+
+// builtin 返回内置的服务，用户注册了同名的服务时优先用用户的
+func builtin() *service {
+	builtinOnce.Do(func() {
+		s := &service{rcvr: reflect.ValueOf(health{}), typ: reflect.TypeOf(health{})}
+		s.name = PingMethod[:strings.LastIndex(PingMethod, ".")]
+		s.registerMethods()
+		builtinService = s
+	})
+	return builtinService
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"geerpc/metadata"
+	"reflect"
+)
+
+// ServerInfo 描述一次服务端调用，交给拦截器使用
+type ServerInfo struct {
+	ServiceMethod string      // 格式 Service.Method
+	Meta          metadata.MD // 请求元数据，和 metadata.FromIncomingContext 拿到的是同一个
+}
+
+// Handler 真正执行注册的方法，argv 和 replyv 的类型要和方法的参数一致。
+// 流式方法的 argv 或 replyv 是对应的 Stream，双向流式方法的 replyv 是 nil
+type Handler func(ctx context.Context, argv, replyv interface{}) error
+
+// ServerInterceptor 包在每次方法调用外面，可以用来做日志、鉴权、监控等。
+// 拦截器需要调用 handler 才会继续往下执行，不调用就直接返回 err 给客户端。
+type ServerInterceptor func(ctx context.Context, info *ServerInfo, argv, replyv interface{}, handler Handler) error
+
+// Use 注册服务端拦截器，先注册的在外层，也就是先执行
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// Use registers interceptors on the DefaultServer
+func Use(interceptors ...ServerInterceptor) { DefaultServer.Use(interceptors...) }
+
+// invoke 检查授权规则后经过拦截器链调用 req 对应的方法
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	if err := server.authorize(ctx, req.h.ServiceMethod); err != nil {
+		return err
+	}
+	server.mu.RLock()
+	interceptors := server.interceptors
+	server.mu.RUnlock()
+
+	handler := func(ctx context.Context, argv, replyv interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(replyv))
+	}
+	if len(interceptors) == 0 {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	info := &ServerInfo{ServiceMethod: req.h.ServiceMethod, Meta: md}
+	return chainServerInterceptors(interceptors, info, handler)(ctx, valueInterface(req.argv), valueInterface(req.replyv))
+}
+
+// valueInterface 和 v.Interface() 一样，只是无效的 Value 返回 nil
+func valueInterface(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// chainServerInterceptors 从里往外把拦截器一层层包到 handler 上
+func chainServerInterceptors(interceptors []ServerInterceptor, info *ServerInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, replyv interface{}) error {
+			return interceptor(ctx, info, argv, replyv, next)
+		}
+	}
+	return handler
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geerpc/auth"
+	"geerpc/peer"
+	"geerpc/status"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Policy 是按方法授权的规则，配置文件是 JSON:
+//
+//	{
+//		"roles": {"alice": ["admin"]},
+//		"rules": [
+//			{"method": "Admin.*", "roles": ["admin"]},
+//			{"method": "Foo.Sum", "public": true}
+//		],
+//		"default_allow": false
+//	}
+//
+// 规则按顺序匹配，第一条匹配的规则决定结果，都不匹配时看 DefaultAllow
+type Policy struct {
+	Roles        map[string][]string `json:"roles"` // 调用方名字到角色，和 auth.Principal.Roles 合并
+	Rules        []Rule              `json:"rules"`
+	DefaultAllow bool                `json:"default_allow"`
+}
+
+// Rule 是一条授权规则。Public 为 true 时所有调用方都可以，包括没有认证的；
+// 否则必须认证，Roles 和 Principals 都为空时任何认证过的调用方都可以，
+// 不为空时调用方要在 Principals 里或者有 Roles 里的任意一个角色
+type Rule struct {
+	Method     string   `json:"method"` // Service.Method，支持 path.Match 的通配符，如 Admin.*
+	Public     bool     `json:"public"`
+	Roles      []string `json:"roles"`
+	Principals []string `json:"principals"`
+}
+
+// ParsePolicy 解析并检查 JSON 格式的授权规则
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("rpc server: invalid policy: %w", err)
+	}
+	for i, r := range p.Rules {
+		if r.Method == "" {
+			return nil, fmt.Errorf("rpc server: invalid policy: rule %d has no method", i)
+		}
+		if _, err := path.Match(r.Method, ""); err != nil {
+			return nil, fmt.Errorf("rpc server: invalid policy: rule %d method %q: %w", i, r.Method, err)
+		}
+	}
+	return &p, nil
+}
+
+// LoadPolicyFile 从文件读授权规则
+func LoadPolicyFile(name string) (*Policy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// Authorize 判断 p 能否调用 serviceMethod，p 为 nil 表示没有认证。
+// 返回匹配的规则，没有匹配时为 "default"
+func (policy *Policy) Authorize(p *auth.Principal, serviceMethod string) (rule string, ok bool) {
+	for _, r := range policy.Rules {
+		if matched, _ := path.Match(r.Method, serviceMethod); matched {
+			return r.Method, policy.allows(&r, p)
+		}
+	}
+	return "default", policy.DefaultAllow
+}
+
+func (policy *Policy) allows(r *Rule, p *auth.Principal) bool {
+	if r.Public {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if len(r.Roles) == 0 && len(r.Principals) == 0 {
+		return true
+	}
+	for _, name := range r.Principals {
+		if name == p.Name {
+			return true
+		}
+	}
+	for _, role := range r.Roles {
+		if p.HasRole(role) || contains(policy.Roles[p.Name], role) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPolicy 设置授权规则，在拦截器和方法之前检查，nil 表示不做授权。可以随时替换，对之后的请求生效
+func (s *Server) SetPolicy(p *Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = p
+}
+
+// Policy returns the policy set by SetPolicy
+func (s *Server) Policy() *Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy
+}
+
+// LoadPolicy 从文件读授权规则并替换当前的规则，文件有错时保留原来的规则
+func (s *Server) LoadPolicy(name string) error {
+	p, err := LoadPolicyFile(name)
+	if err != nil {
+		return err
+	}
+	s.SetPolicy(p)
+	return nil
+}
+
+// WatchPolicy 先加载一次规则文件，之后每隔 interval 检查文件，修改过就重新加载，
+// 重新加载失败只记日志。调用返回的 stop 停止检查
+func (s *Server) WatchPolicy(name string, interval time.Duration) (stop func(), err error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.LoadPolicy(name); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cur, err := os.Stat(name)
+			if err != nil || (cur.ModTime().Equal(info.ModTime()) && cur.Size() == info.Size()) {
+				continue
+			}
+			info = cur
+			if err := s.LoadPolicy(name); err != nil {
+				log.Println("rpc server: reload policy error:", err)
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+// AuditEntry 是审计日志里的一条记录，每行一个 JSON
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Principal string    `json:"principal,omitempty"` // 没有认证时为空
+	Peer      string    `json:"peer,omitempty"`
+	Rule      string    `json:"rule"` // 拒绝这次调用的规则
+}
+
+// SetAuditLog 设置记录授权拒绝的地方，nil 表示写到标准的 log 里
+func (s *Server) SetAuditLog(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = w
+}
+
+// authorize 用当前的授权规则检查调用，拒绝时写审计日志并返回 PermissionDenied
+func (s *Server) authorize(ctx context.Context, serviceMethod string) error {
+	s.mu.RLock()
+	policy, w := s.policy, s.audit
+	s.mu.RUnlock()
+	if policy == nil || serviceMethod == PingMethod {
+		return nil
+	}
+	p, _ := auth.FromContext(ctx)
+	rule, ok := policy.Authorize(p, serviceMethod)
+	if ok {
+		return nil
+	}
+	entry := &AuditEntry{Time: time.Now(), Method: serviceMethod, Rule: rule}
+	if p != nil {
+		entry.Principal = p.Name
+	}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		entry.Peer = pr.Addr.String()
+	}
+	line, _ := json.Marshal(entry)
+	if w == nil {
+		log.Printf("rpc audit: %s", line)
+	} else {
+		s.auditMu.Lock()
+		_, err := w.Write(append(line, '\n'))
+		s.auditMu.Unlock()
+		if err != nil {
+			log.Println("rpc server: write audit log error:", err)
+		}
+	}
+	return status.Errorf(status.PermissionDenied, "rpc server: permission denied for %s", serviceMethod)
+}
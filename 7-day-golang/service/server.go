@@ -1,27 +1,53 @@
 package service
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"geerpc/auth"
 	"geerpc/codec"
+	"geerpc/compress"
+	"geerpc/metadata"
+	"geerpc/peer"
+	"geerpc/status"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MagicNumber = 0x3bef5c
 type Server struct {
+	compressStats compress.Stats // 所有连接的压缩计数，放在第一个保证 64 位对齐
 	serviceMap sync.Map
+	mu sync.RWMutex // protect following
+	interceptors []ServerInterceptor
+	codecs []codec.Type // 为空时支持所有注册过的编解码器
+	maxMessageSize int
+	maxOneWay int
+	verifier auth.Verifier // 为 nil 时不需要认证
+	policy *Policy // 为 nil 时不做授权
+	audit io.Writer
+	auditMu sync.Mutex // 审计日志的 Writer 不一定能并发写
 }
 //注册服务到server里
-func (server *Server)Register(rcvr interface{}) error{
+func (server *Server)Register(rcvr interface{}, opts ...RegisterOption) error{
 	s := newService(rcvr)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return err
+		}
+	}
 	if _,dup := server.serviceMap.LoadOrStore(s.name,s);dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
@@ -30,26 +56,29 @@ func (server *Server)Register(rcvr interface{}) error{
 // DefaultServer is the default instance of *Server.
 var DefaultServer = NewServer()
 //注册一个默认的方便使用
-func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
+func Register(rcvr interface{}, opts ...RegisterOption) error { return DefaultServer.Register(rcvr, opts...) }
 
 //查找服务名
 func (server *Server) findService(serviceMethod string)(svc *service , mtype *methodType,err error){
 	//根据 service.method招服务
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = status.Errorf(status.InvalidArgument, "rpc server: service/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svci, ok := server.serviceMap.Load(serviceName)
+	if !ok && serviceName == builtin().name {
+		svci, ok = builtin(), true
+	}
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = status.Errorf(status.NotFound, "rpc server: can't find service %s", serviceName)
 		return
 	}
 	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = status.Errorf(status.NotFound, "rpc server: can't find method %s", methodName)
 	}
 	return
 }
@@ -59,17 +88,32 @@ type  request struct{
 	argv,replyv reflect.Value
 	mtype *methodType
 	svc *service
+	ctx context.Context // 连接断开、客户端取消时会被 cancel
+	cancel context.CancelFunc
+	deadline time.Time // 调用方传过来的截止时间，零值表示没有
+	stream *serverStream // 流式方法的发送端，普通方法为 nil
+	msg codec.RawMessage // KindStreamMsg 里还没有解码的消息
+	release func() // 单向调用处理完后释放占用的名额，普通请求为 nil
 }
 
 //option 用于决定通信协议类型
-//整个RPC编码的格式如下
+//老协议(版本 1)的格式如下
 //| Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
 //| <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
+//分帧协议(版本 2)的格式见 codec.FrameCodec，Option 放在第一个握手帧里，服务端两种都接受
 type Option struct {
 	MagicNumber int        // MagicNumber marks this's a geerpc request
 	CodecType   codec.Type // client may choose different Codec to encode body
 	ConnectTimeout time.Duration //连接超时
 	HandleTimeout time.Duration // 处理超时
+	Legacy bool `json:"-"` // 客户端使用老协议，用来连接还没升级的服务端
+	MaxMessageSize int `json:"-"` // 客户端能接受的最大回复，0 表示 codec.DefaultMaxMessageSize
+	TLSConfig *tls.Config `json:"-"` // 客户端用 tls@addr 连接时使用，ServerName 为空时取地址里的 host
+	// Compressor 是握手之后整个连接使用的压缩算法，见 compress 包，空表示不压缩。
+	// 老协议没有握手回复，不认识这个字段的老服务端会出错，只能对升级过的服务端使用
+	Compressor string `json:"Compressor,omitempty"`
+	CompressMinSize int `json:"CompressMinSize,omitempty"` // 小于它的消息不压缩，0 表示 compress.DefaultMinSize，两端都使用
+	Credentials auth.Credentials `json:"-"` // 服务端要求认证时用来生成凭证，只支持分帧协议
 }
 
 var DefaultOption = &Option{
@@ -101,29 +145,441 @@ func (s *Server) Accept(lis net.Listener){
 // for each incoming connection.
 func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 
+// ListenTLS 创建 TLS 监听，直接交给 Accept 使用，请求的 context 里可以用 peer.FromContext 拿到客户端证书
+func ListenTLS(network, address string, config *tls.Config) (net.Listener, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, errors.New("rpc server: ListenTLS needs a server certificate")
+	}
+	return tls.Listen(network, address, config)
+}
+
+// NewTLSConfig 返回服务端的 TLS 配置，clientCAs 不为 nil 时要求并验证客户端证书(mTLS)
+func NewTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
 func (s *Server) ServerConn(conn io.ReadWriteCloser) {
+	p, err := newPeer(conn)
+	if err != nil {
+		log.Println("rpc server: tls handshake error:", err)
+		_ = conn.Close()
+		return
+	}
+	ctx := peer.NewContext(context.Background(), p)
+	// 第一个字节区分协议: 分帧协议以 0 开头，老协议是 JSON 编码的 Option
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		log.Println("rpc server: options error: ", err)
+		_ = conn.Close()
+		return
+	}
+	if b[0] == byte(codec.FrameMagic>>24) {
+		s.serveFramed(ctx, &bufferedConn{r, conn})
+		return
+	}
+	s.serveLegacy(ctx, &bufferedConn{r, conn})
+}
+
+// newPeer 记录连接的对端信息，TLS 连接先完成握手才能拿到证书
+func newPeer(conn io.ReadWriteCloser) (*peer.Peer, error) {
+	p := &peer.Peer{}
+	if nc, ok := conn.(net.Conn); ok {
+		p.Addr = nc.RemoteAddr()
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		state := tc.ConnectionState()
+		p.TLS = &state
+	}
+	return p, nil
+}
+
+// serveFramed 处理分帧协议的连接，握手的结果总会回复给客户端
+func (s *Server) serveFramed(ctx context.Context, conn io.ReadWriteCloser) {
+	c := codec.NewFrameCodec(conn, nil, s.MaxMessageSize())
+	var option Option
+	if err := c.ReadHandshake(&option); err != nil {
+		log.Println("rpc server: handshake error:", err)
+		var verr *codec.VersionError
+		if errors.As(err, &verr) {
+			s.replyHandshake(c, status.New(status.Unimplemented, err.Error()), "")
+		}
+		_ = c.Close()
+		return
+	}
+	if err := s.checkOption(&option); err != nil {
+		s.replyHandshake(c, err, "")
+		_ = c.Close()
+		return
+	}
+	m, ok := codec.GetMarshaler(option.CodecType)
+	if !ok {
+		s.replyHandshake(c, status.New(status.Unimplemented, fmt.Sprintf("rpc server: codec type %s can't be framed", option.CodecType)), "")
+		_ = c.Close()
+		return
+	}
+	c.SetMarshaler(m)
+	verifier := s.Verifier()
+	var nonce string
+	if verifier != nil {
+		var err error
+		if nonce, err = auth.NewNonce(); err != nil {
+			s.replyHandshake(c, status.New(status.Internal, "rpc server: can't generate nonce"), "")
+			_ = c.Close()
+			return
+		}
+	}
+	if s.replyHandshake(c, nil, nonce) != nil {
+		return
+	}
+	if verifier != nil {
+		p, err := s.authenticate(ctx, c, verifier, nonce)
+		if err != nil {
+			s.replyHandshake(c, err, "")
+			_ = c.Close()
+			return
+		}
+		if s.replyHandshake(c, nil, "") != nil {
+			return
+		}
+		ctx = auth.NewContext(ctx, p)
+	}
+	if option.Compressor != "" {
+		// 客户端收到握手回复之前不会再发数据，握手用的 codec 里没有多读的字节
+		c = codec.NewFrameCodec(s.compressConn(conn, &option), m, s.MaxMessageSize())
+	}
+	s.serveCodec(ctx, c, option.HandleTimeout)
+}
+
+// serveLegacy 处理老协议的连接: | Option(JSON) | Header | Body | Header | Body | ...
+func (s *Server) serveLegacy(ctx context.Context, conn io.ReadWriteCloser) {
 	//先decode Option
 	var option Option
-	if err := json.NewDecoder(conn).Decode(&option); err!=nil{
-		log.Println("rpc server: options error: ", err)
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&option); err!=nil{
+		log.Println("rpc server: options error, protocol mismatch? ", err)
+		_ = conn.Close()
 		return
 	}
+	if err := s.checkOption(&option); err != nil {
+		s.rejectHandshake(conn, err)
+		return
+	}
+	if s.Verifier() != nil {
+		// 老协议握手成功时服务端不回复，没法发随机数
+		s.rejectHandshake(conn, status.New(status.Unauthenticated, "rpc server: authentication requires the framed protocol"))
+		return
+	}
+	f, _ := codec.Get(option.CodecType) //根据编码类型选择编码器初始化函数
+	// json decoder 可能多读了后面 header 的字节，需要先还给 codec
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = r.Discard(1) // json.Encoder 在 Option 后面追加的换行
+	}
+	cc := s.compressConn(&bufferedConn{r, conn}, &option)
+	s.serveCodec(ctx, codec.FlushWrites(f(cc), cc), option.HandleTimeout)
+}
+
+// compressConn 按 Option 里的压缩算法包装连接，不压缩时原样返回
+func (s *Server) compressConn(conn io.ReadWriteCloser, option *Option) io.ReadWriteCloser {
+	if option.Compressor == "" {
+		return conn
+	}
+	cp, _ := compress.Get(option.Compressor) // checkOption 已经检查过
+	return compress.NewConn(conn, cp, option.CompressMinSize, &s.compressStats)
+}
+
+// CompressionStats 返回所有连接压缩前后的字节数，用于调试
+func (s *Server) CompressionStats() compress.Stats {
+	return s.compressStats.Snapshot()
+}
+
+// checkOption 检查 magic number 和编码类型
+func (s *Server) checkOption(option *Option) *status.Status {
 	if option.MagicNumber != MagicNumber {
 		log.Printf("rpc server: invalid magic number %x", option.MagicNumber)
-		return
+		return status.New(status.InvalidArgument, fmt.Sprintf("rpc server: invalid magic number %x", option.MagicNumber))
 	}
-	f := codec.NewCodecFuncMap[option.CodecType] //根据编码类型选择编码器初始化函数
-	if f == nil{
+	if _, ok := codec.Get(option.CodecType); !ok || !s.supports(option.CodecType) {
 		log.Printf("rpc server: invalid codec type %s", option.CodecType)
-		return
+		return status.New(status.Unimplemented, fmt.Sprintf("rpc server: codec type %s not supported", option.CodecType))
+	}
+	if _, ok := compress.Get(option.Compressor); option.Compressor != "" && !ok {
+		log.Printf("rpc server: invalid compressor %s", option.Compressor)
+		return status.New(status.Unimplemented, fmt.Sprintf("rpc server: compressor %s not supported", option.Compressor))
+	}
+	return nil
+}
+
+// authenticate 读客户端的凭证并交给 verifier 验证，失败的原因只记在服务端的日志里
+func (s *Server) authenticate(ctx context.Context, c *codec.FrameCodec, verifier auth.Verifier, nonce string) (*auth.Principal, *status.Status) {
+	var cred auth.Credential
+	if err := c.ReadHandshake(&cred); err != nil {
+		log.Println("rpc server: read credential error:", err)
+		return nil, status.New(status.Unauthenticated, "rpc server: missing credential")
+	}
+	p, err := verifier.Verify(ctx, nonce, &cred)
+	if err == nil && p == nil {
+		err = errors.New("verifier returned no principal")
+	}
+	if err != nil {
+		log.Printf("rpc server: authentication failed (scheme %q): %v", cred.Scheme, err)
+		if st, ok := status.FromError(err); ok && st.Code != status.Unknown {
+			return nil, st
+		}
+		return nil, status.New(status.Unauthenticated, "rpc server: authentication failed")
+	}
+	return p, nil
+}
+
+// replyHandshake 回复分帧协议的握手帧，err 为 nil 表示接受，nonce 不为空表示客户端接着要发凭证
+func (s *Server) replyHandshake(c *codec.FrameCodec, err *status.Status, nonce string) error {
+	reply := &HandshakeReply{Codecs: s.framedCodecs(), Compressors: compress.Names(), Nonce: nonce}
+	if err != nil {
+		reply.Error, reply.Code = err.Message, uint32(err.Code)
+	}
+	if e := c.WriteHandshake(reply); e != nil {
+		log.Println("rpc server: write handshake error:", e)
+		return e
+	}
+	return nil
+}
+
+// SetMaxMessageSize 限制分帧协议里 header 和 body 的最大长度，超过的 body 会被跳过并回复错误
+func (s *Server) SetMaxMessageSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxMessageSize = n
+}
+
+// MaxMessageSize returns the message size limit, 0 means codec.DefaultMaxMessageSize
+func (s *Server) MaxMessageSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxMessageSize
+}
+
+// SetVerifier 要求客户端在握手时认证，认证通过的 auth.Principal 会放进这个连接上每个请求的 context。
+// 设为 nil 关闭认证，只影响之后建立的连接
+func (s *Server) SetVerifier(v auth.Verifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verifier = v
+}
+
+// Verifier returns the verifier set by SetVerifier
+func (s *Server) Verifier() auth.Verifier {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.verifier
+}
+
+// DefaultMaxOneWay 是每个连接默认最多同时处理的单向调用数
+const DefaultMaxOneWay = 64
+
+// SetMaxOneWay 限制每个连接同时处理的单向调用数，超过的单向调用直接丢掉并打日志，
+// 这样单向调用刷屏不会耗尽服务端的 goroutine，服务端也一直在读，连接断开时能取消正在处理的调用
+func (s *Server) SetMaxOneWay(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxOneWay = n
+}
+
+// MaxOneWay returns the per-connection limit of one-way calls being handled
+func (s *Server) MaxOneWay() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.maxOneWay <= 0 {
+		return DefaultMaxOneWay
+	}
+	return s.maxOneWay
+}
+
+// SetCodecs 限制服务端只接受 types 里的编解码器
+func (s *Server) SetCodecs(types ...codec.Type) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codecs = append([]codec.Type(nil), types...)
+}
+
+// Codecs 返回服务端支持的编解码器，握手失败时会告诉客户端
+func (s *Server) Codecs() []codec.Type {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.codecs) == 0 {
+		return codec.Types()
+	}
+	return append([]codec.Type(nil), s.codecs...)
+}
+
+// framedCodecs 返回分帧协议能用的编解码器，没有 Marshaler 的只能走老协议，不告诉分帧协议的客户端
+func (s *Server) framedCodecs() []codec.Type {
+	var types []codec.Type
+	for _, t := range s.Codecs() {
+		if _, ok := codec.GetMarshaler(t); ok {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (s *Server) supports(t codec.Type) bool {
+	for _, c := range s.Codecs() {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+// HandshakeReply 是服务端对 Option 的回复。分帧协议总会回复；
+// 老协议只在拒绝时写回 JSON 然后关闭连接，握手成功时什么都不写，和老的客户端保持兼容
+type HandshakeReply struct {
+	Error  string       `json:"Error"`
+	Code   uint32       `json:"Code"`
+	Codecs []codec.Type `json:"Codecs"` // 服务端支持的编解码器，分帧协议的回复里只有能分帧的
+	Compressors []string `json:"Compressors,omitempty"` // 服务端支持的压缩算法
+	// Nonce 不为空表示服务端要求认证，客户端要用它生成 auth.Credential 放在下一个握手帧里发过来，
+	// 服务端再用一个 HandshakeReply 回复认证的结果
+	Nonce string `json:"Nonce,omitempty"`
+}
+
+// HandshakeEnvelope 包一层特殊的 key，老协议的客户端靠它和正常的回复区分开
+type HandshakeEnvelope struct {
+	Handshake *HandshakeReply `json:"GeerpcHandshake"`
+}
+
+func (s *Server) rejectHandshake(conn io.ReadWriteCloser, err *status.Status) {
+	reply := &HandshakeReply{Error: err.Message, Code: uint32(err.Code), Codecs: s.Codecs(), Compressors: compress.Names()}
+	if e := json.NewEncoder(conn).Encode(&HandshakeEnvelope{Handshake: reply}); e != nil {
+		log.Println("rpc server: write handshake error:", e)
 	}
-	s.ServerCodec(f(conn),option.HandleTimeout)
+	_ = conn.Close()
+}
+
+// bufferedConn 先读 r 里剩下的数据，写和关闭仍然走原来的连接
+type bufferedConn struct {
+	r io.Reader
+	io.ReadWriteCloser
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// inflight 记录一个连接上正在处理的请求，用于按 Seq 取消和更新流控窗口
+type inflight struct {
+	mu      sync.Mutex
+	calls   map[uint64]context.CancelFunc
+	streams map[uint64]*serverStream
+}
+
+func newInflight() *inflight {
+	return &inflight{calls: make(map[uint64]context.CancelFunc), streams: make(map[uint64]*serverStream)}
+}
+
+// start 为请求派生一个 context，deadline 不为零时带上截止时间，
+// 返回的 cancel 会同时把请求从表里删掉
+func (f *inflight) start(parent context.Context, seq uint64, deadline time.Time) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(parent)
+	} else {
+		ctx, cancel = context.WithDeadline(parent, deadline)
+	}
+	f.mu.Lock()
+	f.calls[seq] = cancel
+	f.mu.Unlock()
+	return ctx, func() {
+		cancel()
+		f.mu.Lock()
+		delete(f.calls, seq)
+		delete(f.streams, seq)
+		f.mu.Unlock()
+	}
+}
+
+// addStream 记录流式请求的发送端，请求结束时由 start 返回的 cancel 删除
+func (f *inflight) addStream(seq uint64, st *serverStream) {
+	f.mu.Lock()
+	f.streams[seq] = st
+	f.mu.Unlock()
+}
+
+// grant 增加序列号为 seq 的流的发送窗口
+func (f *inflight) grant(seq uint64, n uint32) {
+	if st := f.stream(seq); st != nil {
+		st.window.Add(int(n))
+	}
+}
+
+// deliver 把客户端在流里发的消息交给序列号为 seq 的流，流已经结束时直接丢掉
+func (f *inflight) deliver(seq uint64, msg codec.RawMessage) {
+	if st := f.stream(seq); st != nil {
+		st.deliver(msg)
+	}
+}
+
+// closeRecv 结束序列号为 seq 的流的接收
+func (f *inflight) closeRecv(seq uint64, err error) {
+	if st := f.stream(seq); st != nil {
+		st.closeRecv(err)
+	}
+}
+
+func (f *inflight) stream(seq uint64) *serverStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[seq]
+}
+
+// cancel 取消序列号为 seq 的请求，请求不存在时返回 false
+func (f *inflight) cancel(seq uint64) bool {
+	f.mu.Lock()
+	cancel, ok := f.calls[seq]
+	f.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
 }
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{ }{}
+
+var errDeadlineExceeded = status.New(status.DeadlineExceeded, "rpc server: request deadline exceeded")
+
+var errOneWayExhausted = status.New(status.ResourceExhausted, "rpc server: too many one-way calls in flight")
+
+// setError 把 err 写进回复的 header，错误码随 header 一起传给客户端
+func setError(h *codec.Header, err error) {
+	st := status.Convert(err)
+	h.Error = st.Message
+	h.Code = uint32(st.Code)
+	h.Details = st.Details
+}
 func (s *Server) ServerCodec( c codec.Codec,timeout time.Duration){
+	s.serveCodec(context.Background(), c, timeout)
+}
+
+// serveCodec 处理一个连接上的所有请求，每个请求的 context 都从 base 派生，里面有连接的 peer.Peer
+func (s *Server) serveCodec(base context.Context, c codec.Codec, timeout time.Duration) {
 	sending := new(sync.Mutex) // 添加互斥锁保证完整发送
 	wg := new(sync.WaitGroup)  // wait until all request are handled
+	ctx, cancel := context.WithCancel(base) // 连接断开时取消所有请求
+	calls := newInflight()
+	oneway := make(chan struct{}, s.MaxOneWay())
 
 	for{
 		req,err := s.readRequest(c)//读请求
@@ -131,18 +587,95 @@ func (s *Server) ServerCodec( c codec.Codec,timeout time.Duration){
 			if req == nil{
 				break
 			}
-			req.h.Error = err.Error()
-			s.sendResponse(c, req.h, invalidRequest, sending)
+			if req.h.Kind == codec.KindStreamMsg {
+				// 流里的消息出错只结束这个流的接收，最后的回复由方法返回时发送
+				calls.closeRecv(req.h.Seq, err)
+				continue
+			}
+			s.replyError(c, req, err, sending)
+			continue
+		}
+		switch req.h.Kind {
+		case codec.KindCancel:
+			calls.cancel(req.h.Seq) // 客户端不再等待这个请求了
+			continue
+		case codec.KindWindowUpdate:
+			calls.grant(req.h.Seq, req.h.Credit)
+			continue
+		case codec.KindStreamMsg:
+			calls.deliver(req.h.Seq, req.msg)
+			continue
+		case codec.KindCloseSend:
+			calls.closeRecv(req.h.Seq, nil)
+			continue
+		}
+		if err := checkKind(c, req); err != nil {
+			s.replyError(c, req, err, sending)
+			continue
+		}
+		if !req.deadline.IsZero() && !time.Now().Before(req.deadline) {
+			// 调用方已经等不到结果了，不再分发
+			s.replyError(c, req, errDeadlineExceeded, sending)
 			continue
 		}
+		if req.h.Kind == codec.KindOneWay {
+			// 没有人等单向调用的回复，用信号量限制同时处理的数量。满了就丢掉这个调用而不是停下来，
+			// 读循环要一直读，才能发现连接断开并取消正在处理的请求
+			select {
+			case oneway <- struct{}{}:
+				req.release = func() { <-oneway }
+			default:
+				s.replyError(c, req, errOneWayExhausted, sending)
+				continue
+			}
+		}
+		req.ctx, req.cancel = calls.start(ctx, req.h.Seq, req.deadline)
+		req.ctx = metadata.NewIncomingContext(req.ctx, req.h.Meta)
+		req.h.Meta = nil // header 会复用为回复的 header
+		if req.mtype.kind != unaryMethod {
+			req.stream = newServerStream(req.ctx, c, req.h.Seq, sending, req.h.Credit)
+			if req.mtype.kind == serverStreamMethod {
+				req.replyv = reflect.ValueOf(req.stream)
+			} else {
+				req.argv = reflect.ValueOf(req.stream)
+			}
+			calls.addStream(req.h.Seq, req.stream)
+		}
+		req.h.Kind, req.h.Credit = codec.KindRequest, 0
 		wg.Add(1)
 		go s.handleRequest(c, req, sending, wg,timeout)//处理请求
 	}
 	//没有请求了会跳出循环
+	cancel()
 	wg.Wait()
 	_ = c.Close()
 }
 
+// replyError 回复分发之前的错误，单向调用没有人等回复，只打日志
+func (s *Server) replyError(c codec.Codec, req *request, err error, sending *sync.Mutex) {
+	if req.h.Kind == codec.KindOneWay {
+		log.Printf("rpc server: drop one-way call %s: %v", req.h.ServiceMethod, err)
+		return
+	}
+	setError(req.h, err)
+	s.sendResponse(c, req.h, invalidRequest, sending)
+}
+
+// checkKind 检查请求的类型和方法是否匹配，流式方法只能通过分帧协议调用，单向调用只能调用普通方法
+func checkKind(c codec.Codec, req *request) error {
+	stream := req.mtype.kind != unaryMethod
+	if stream != (req.h.Kind == codec.KindStreamOpen) {
+		if stream {
+			return status.Errorf(status.InvalidArgument, "rpc server: %s is a streaming method", req.h.ServiceMethod)
+		}
+		return status.Errorf(status.InvalidArgument, "rpc server: %s is not a streaming method", req.h.ServiceMethod)
+	}
+	if _, ok := c.(*codec.FrameCodec); stream && !ok {
+		return errNotFramed
+	}
+	return nil
+}
+
 //serveCodec 的过程
 //读取请求 readRequest
 //处理请求 handleRequest
@@ -167,13 +700,53 @@ func (s *Server) readRequest(c codec.Codec) (*request, error){
 		return nil, err
 	}
 	req := &request{h: h}
+	if h.Timeout > 0 {
+		req.deadline = time.Now().Add(h.Timeout)
+		h.Timeout = 0 // header 会复用为回复的 header
+	}
+	switch h.Kind {
+	case codec.KindCancel, codec.KindWindowUpdate, codec.KindCloseSend:
+		// 控制帧的 body 是空的占位
+		if err = c.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	case codec.KindStreamMsg:
+		// 消息等到方法调用 Recv 时再解码
+		if err = c.ReadBody(&req.msg); err != nil {
+			if _, ok := status.FromError(err); !ok {
+				return nil, err
+			}
+		}
+		return req, err
+	}
 	//根据header确认要请求的服务和方法
 	req.svc,req.mtype,err = s.findService(h.ServiceMethod)
 	if err != nil {
+		// body 还是要读掉，否则后面的请求会错位
+		if e := c.ReadBody(nil); e != nil {
+			return nil, e
+		}
 		return req, err
 	}
+	if req.mtype.hasReply() {
+		req.replyv = req.mtype.newReplyv()
+	}
+	if req.mtype.kind == clientStreamMethod || req.mtype.kind == bidiStreamMethod {
+		// 参数在流里发送，打开流的请求 body 是空的占位
+		if err = c.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if isEmpty(req.mtype.ArgType) {
+		// 空参数只有占位的 body，不用解码
+		if err = c.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
 
 	// readbody需要传入一个指针
 	argvi := req.argv.Interface()
@@ -183,45 +756,110 @@ func (s *Server) readRequest(c codec.Codec) (*request, error){
 	//读body
 	if err = c.ReadBody(argvi); err != nil {
 		log.Println("rpc server: read argv err:", err)
+		// 分帧协议已经跳过了这个 body，直接给客户端回复错误；老协议如果错位了，下一次读 header 会失败
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(status.InvalidArgument, "rpc server: read argv err: %v", err)
+		}
+		return req, err
 	}
 	return req, nil
 }
 func (s *Server) handleRequest(c codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration){
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	defer req.cancel()
+	ctx := req.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if req.stream != nil {
+		req.stream.ctx = ctx // 超时后 Send 也会失败
+	}
+	called := make(chan error, 1) // 带缓冲，超时返回后方法 goroutine 也能退出
 	go func(){
-		err := req.svc.call(req.mtype,req.argv,req.replyv)
-		called <- struct{}{} //调用结束
-		if err != nil {
-			req.h.Error = err.Error()
+		defer func() {
+			// 一个请求 panic 不能影响整个进程和同一连接上的其他请求
+			if p := recover(); p != nil {
+				called <- recoverPanic(req, p)
+			}
+			if req.release != nil {
+				req.release() // 方法真正返回后才释放名额，超时返回时方法可能还在执行
+			}
+		}()
+		called <- s.invoke(ctx, req)
+	}()
+	select{
+	case <-ctx.Done():
+		req.closeStream()
+		if req.release != nil {
+			log.Printf("rpc server: one-way call %s: %v", req.h.ServiceMethod, ctx.Err())
+			return
+		}
+		switch req.ctx.Err() {
+		case nil:
+			setError(req.h, status.Errorf(status.DeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+		case context.DeadlineExceeded:
+			setError(req.h, errDeadlineExceeded)
+		default:
+			return // 客户端已经断开或取消，不需要回复
+		}
+		req.h.Meta = req.replyMeta()
+		s.sendResponse(c, req.h, invalidRequest, sending)
+	case err := <-called:
+		req.closeStream()
+		if req.release != nil {
+			if err != nil {
+				log.Printf("rpc server: one-way call %s: %v", req.h.ServiceMethod, err)
+			}
+			return // 单向调用不回复
+		}
+		req.h.Meta = req.replyMeta()
+		if err != nil || !req.mtype.hasReply() || isEmpty(req.mtype.ReplyType) {
+			// 流式发送的方法消息已经发完了，最后的回复只带状态；空的回复也只发占位
+			setError(req.h, err)
 			s.sendResponse(c, req.h, invalidRequest, sending)
-			sent <- struct{}{}//回复结束
 			return
 		}
 		s.sendResponse(c,req.h,req.replyv.Interface(),sending)
-		sent <- struct{}{}//回复结束
-	}()
-	//如果没有时间限制，等待执行完就返回
-	if(timeout == 0){
-		<- called
-		<- sent
-		return
 	}
-	select{
-		case <-time.After(timeout):
-			req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-			s.sendResponse(c, req.h, invalidRequest, sending)
-		case <-called:
-			<-sent
+}
+// replyMeta 返回回复的元数据，幂等方法加上 IdempotentKey
+func (req *request) replyMeta() metadata.MD {
+	md := metadata.ResponseFromIncomingContext(req.ctx)
+	if req.mtype.idempotent {
+		md = metadata.Join(md, metadata.Pairs(IdempotentKey, "true"))
 	}
+	return md
+}
 
+// closeStream 让流式方法残留的 Send 失败，保证最后的回复是这个流的最后一帧
+func (req *request) closeStream() {
+	if req.stream != nil {
+		req.stream.close()
+	}
+}
+
+// ErrInternal 是 handler panic 时回复给客户端的错误，客户端可以用 errors.Is 判断
+var ErrInternal = status.New(status.Internal, "rpc server: internal error")
+
+// recoverPanic 打印堆栈、记录次数，把 panic 转成回复给客户端的错误
+func recoverPanic(req *request, p interface{}) error {
+	atomic.AddUint64(&req.mtype.numPanics, 1)
+	log.Printf("rpc server: panic in %s: %v\n%s", req.h.ServiceMethod, p, debug.Stack())
+	return status.Errorf(status.Internal, "%s: panic in %s: %v", ErrInternal.Message, req.h.ServiceMethod, p)
 }
+
 func (s*Server) sendResponse(c codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex){
 	sending.Lock()
 	defer sending.Unlock()
 	if err := c.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
+		// 回复没有写出去（例如超过了大小限制），至少让客户端知道出错了
+		if st, ok := status.FromError(err); ok && body != invalidRequest {
+			setError(h, st)
+			_ = c.Write(h, invalidRequest)
+		}
 	}
 }
 
@@ -2,9 +2,20 @@ package service
 //go 的单元测试：单元测试只需新建一个以 “_test.go” 结尾的文件
 //
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"geerpc/auth"
+	"geerpc/codec"
+	"geerpc/status"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
 	"reflect"
 	"testing"
+	"time"
 )
 //Foo 是一项服务
 type Foo int
@@ -16,6 +27,15 @@ func (f Foo) Sum(args Args, reply *int) error {
 	return nil
 }
 
+// 带 context 的方法
+func (f Foo) SumCtx(ctx context.Context, args Args, reply *int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
 // it's not a exported Method
 func (f Foo) sum(args Args, reply *int) error {
 	*reply = args.Num1 + args.Num2
@@ -31,10 +51,25 @@ func _assert(condition bool, msg string, v ...interface{}) {
 func TestNewService(t *testing.T) {
 	var foo Foo
 	s := newService(&foo)
-	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
+	_assert(len(s.method) == 2, "wrong service Method, expect 2, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
 }
+// Streamer 的方法覆盖三种流式调用的形式
+type Streamer int
+
+func (s Streamer) List(args Args, stream ServerStream) error { return nil }
+func (s Streamer) Upload(ctx context.Context, stream ClientStream, reply *int) error { return nil }
+func (s Streamer) Chat(stream BidiStream) error { return nil }
+
+func TestNewService_StreamMethods(t *testing.T) {
+	var st Streamer
+	s := newService(&st)
+	_assert(len(s.method) == 3, "wrong service Method, expect 3, but got %d", len(s.method))
+	_assert(s.method["List"].kind == serverStreamMethod, "List should be a server streaming method")
+	_assert(s.method["Upload"].kind == clientStreamMethod && s.method["Upload"].withCtx, "Upload should be a client streaming method with context")
+	_assert(s.method["Chat"].kind == bidiStreamMethod && s.method["Chat"].ReplyType == nil, "Chat should be a bidi streaming method")
+}
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
 	s := newService(&foo)
@@ -43,6 +78,255 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
-}
\ No newline at end of file
+}
+func TestMethodType_CallWithContext(t *testing.T) {
+	var foo Foo
+	s := newService(&foo)
+	mType := s.method["SumCtx"]
+	_assert(mType != nil && mType.withCtx, "wrong Method, SumCtx should take a context")
+
+	argv := mType.newArgv()
+	replyv := mType.newReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
+	err := s.call(context.Background(), mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 4, "failed to call Foo.SumCtx")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.call(ctx, mType, argv, mType.newReplyv())
+	_assert(err == context.Canceled, "expect context canceled, but got %v", err)
+}
+
+func TestServer_RejectExpiredDeadline(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	cc := dialPipe(server)
+	defer func() { _ = cc.Close() }()
+
+	// 只剩 1ns 的预算，到服务端时一定已经过期
+	h := pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 1, Timeout: time.Nanosecond}, Args{Num1: 1, Num2: 2}, nil)
+	_assert(h.Seq == 1 && status.Code(h.Code) == status.DeadlineExceeded, "expect deadline exceeded, but got %q", h.Error)
+	_assert(server.mustMethod("Foo.Sum").NumCalls() == 0, "expired request shouldn't be dispatched")
+}
+
+func (server *Server) mustMethod(serviceMethod string) *methodType {
+	_, mtype, err := server.findService(serviceMethod)
+	if err != nil {
+		panic(err)
+	}
+	return mtype
+}
+
+// dialPipe 通过内存管道连上 server，返回客户端这一侧的 codec，默认用 gob
+func dialPipe(server *Server, typ ...codec.Type) codec.Codec {
+	t := codec.GobType
+	if len(typ) > 0 {
+		t = typ[0]
+	}
+	cliConn, srvConn := net.Pipe()
+	go server.ServerConn(srvConn)
+	_ = json.NewEncoder(cliConn).Encode(&Option{MagicNumber: MagicNumber, CodecType: t})
+	f, _ := codec.Get(t)
+	return f(cliConn)
+}
+
+func TestServer_Codecs(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		cc := dialPipe(server, typ)
+		var reply int
+		h := pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2}, &reply)
+		_assert(h.Error == "" && reply == 3, "%s: expect 3, but got %d (%s)", typ, reply, h.Error)
+		h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.NotExist", Seq: 2}, Args{}, nil)
+		_assert(h.Seq == 2 && status.Code(h.Code) == status.NotFound, "%s: expect NotFound, but got %q", typ, h.Error)
+		_ = cc.Close()
+	}
+}
+
+// pipeCall 发一个请求并读回复，net.Pipe 是同步的，所以写要放到另一个 goroutine
+func pipeCall(cc codec.Codec, h *codec.Header, args, reply interface{}) codec.Header {
+	written := make(chan struct{})
+	go func() {
+		_ = cc.Write(h, args)
+		close(written)
+	}()
+	var resp codec.Header
+	_assert(cc.ReadHeader(&resp) == nil && cc.ReadBody(reply) == nil, "failed to read response")
+	<-written
+	return resp
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	var order []string
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, replyv interface{}, handler Handler) error {
+		order = append(order, "outer:"+info.ServiceMethod)
+		err := handler(ctx, argv, replyv)
+		*replyv.(*int) *= 10 // 可以改写回复
+		return err
+	}, func(ctx context.Context, info *ServerInfo, argv, replyv interface{}, handler Handler) error {
+		order = append(order, "inner:"+info.Meta["user"])
+		if info.Meta["user"] == "" {
+			return fmt.Errorf("unauthenticated")
+		}
+		return handler(ctx, argv, replyv)
+	})
+	cc := dialPipe(server)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h := pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 1, Meta: map[string]string{"user": "alice"}}, Args{Num1: 1, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 30, "expect 30, but got %d (%s)", reply, h.Error)
+	_assert(strings.Join(order, ",") == "outer:Foo.Sum,inner:alice", "wrong interceptor order %v", order)
+
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, Args{Num1: 1, Num2: 2}, nil)
+	_assert(h.Error == "unauthenticated", "expect unauthenticated, but got %q", h.Error)
+}
+
+func TestServer_Policy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"roles": {"alice": ["admin"]},
+		"rules": [
+			{"method": "Admin.*", "roles": ["admin"]},
+			{"method": "Foo.Sum", "public": true},
+			{"method": "Foo.*"}
+		]
+	}`))
+	_assert(err == nil, "parse policy error: %v", err)
+	alice, bob := &auth.Principal{Name: "alice"}, &auth.Principal{Name: "bob"}
+	for _, c := range []struct {
+		p      *auth.Principal
+		method string
+		ok     bool
+	}{
+		{alice, "Admin.Drop", true},
+		{bob, "Admin.Drop", false},
+		{&auth.Principal{Name: "carol", Roles: []string{"admin"}}, "Admin.Drop", true},
+		{nil, "Foo.Sum", true},
+		{nil, "Foo.SumCtx", false},
+		{bob, "Foo.SumCtx", true},
+		{alice, "Bar.Baz", false},
+	} {
+		_, ok := policy.Authorize(c.p, c.method)
+		_assert(ok == c.ok, "%v calling %s: expect %v", c.p, c.method, c.ok)
+	}
+	_, err = ParsePolicy([]byte(`{"rules": [{"method": "Foo.[" }]}`))
+	_assert(err != nil, "expect a bad pattern to be rejected")
+
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	var audit bytes.Buffer
+	server.SetAuditLog(&audit)
+	name := filepath.Join(t.TempDir(), "policy.json")
+	_ = ioutil.WriteFile(name, []byte(`{"rules": [{"method": "Foo.Sum", "public": true}]}`), 0644)
+	_assert(server.LoadPolicy(name) == nil, "load policy error")
+	cc := dialPipe(server)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h := pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 3, "expect 3, but got %d (%s)", reply, h.Error)
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.SumCtx", Seq: 2}, Args{Num1: 1, Num2: 2}, nil)
+	_assert(status.Code(h.Code) == status.PermissionDenied, "expect PermissionDenied, but got %d %q", h.Code, h.Error)
+	var entry AuditEntry
+	_assert(json.Unmarshal(audit.Bytes(), &entry) == nil && entry.Method == "Foo.SumCtx" && entry.Rule == "default",
+		"unexpected audit log %q", audit.String())
+
+	// 文件有错时保留原来的规则，改好后重新加载生效
+	_ = ioutil.WriteFile(name, []byte(`{"rules": [`), 0644)
+	_assert(server.LoadPolicy(name) != nil && server.Policy() != nil, "expect the old policy to be kept")
+	// 内置的健康检查不受授权规则限制
+	h = pipeCall(cc, &codec.Header{ServiceMethod: PingMethod, Seq: 3}, struct{}{}, nil)
+	_assert(h.Error == "", "expect ping to be allowed, but got %q", h.Error)
+
+	_ = ioutil.WriteFile(name, []byte(`{"default_allow": true}`), 0644)
+	_assert(server.LoadPolicy(name) == nil, "reload policy error")
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.SumCtx", Seq: 4}, Args{Num1: 1, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 3, "expect 3 after reload, but got %d (%s)", reply, h.Error)
+}
+
+// Boom 的方法会 panic
+type Boom int
+
+func (b Boom) Explode(args Args, reply *int) error {
+	var m map[string]int
+	m["boom"] = args.Num1 // nil map
+	return nil
+}
+
+func TestServer_RecoverPanic(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	var boom Boom
+	_ = server.Register(&foo)
+	_ = server.Register(&boom)
+	cc := dialPipe(server)
+	defer func() { _ = cc.Close() }()
+
+	h := pipeCall(cc, &codec.Header{ServiceMethod: "Boom.Explode", Seq: 1}, Args{Num1: 1}, nil)
+	_assert(status.Code(h.Code) == status.Internal && strings.HasPrefix(h.Error, ErrInternal.Message), "expect internal error, but got %q", h.Error)
+	_assert(server.mustMethod("Boom.Explode").NumPanics() == 1, "expect 1 recovered panic")
+
+	// 连接还能继续用
+	var reply int
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, Args{Num1: 1, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 3, "expect 3 after a panic, but got %d (%s)", reply, h.Error)
+}
+
+// dialFramed 通过内存管道用分帧协议连上 server
+func dialFramed(server *Server) *codec.FrameCodec {
+	cliConn, srvConn := net.Pipe()
+	go server.ServerConn(srvConn)
+	m, _ := codec.GetMarshaler(codec.GobType)
+	cc := codec.NewFrameCodec(cliConn, m, 0)
+	written := make(chan struct{})
+	go func() {
+		_ = cc.WriteHandshake(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+		close(written)
+	}()
+	var reply HandshakeReply
+	_assert(cc.ReadHandshake(&reply) == nil && reply.Error == "", "handshake failed: %s", reply.Error)
+	<-written
+	return cc
+}
+
+func TestServer_FramedProtocol(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetMaxMessageSize(64)
+	cc := dialFramed(server)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h := pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 3, "expect 3, but got %d (%s)", reply, h.Error)
+
+	// 超过大小限制的 body 被跳过
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, strings.Repeat("x", 100), nil)
+	_assert(h.Seq == 2 && status.Code(h.Code) == status.ResourceExhausted, "expect ResourceExhausted, but got %q", h.Error)
+
+	// 解不出来的 body 被跳过
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 3}, "not args", nil)
+	_assert(h.Seq == 3 && status.Code(h.Code) == status.InvalidArgument, "expect InvalidArgument, but got %q", h.Error)
+
+	h = pipeCall(cc, &codec.Header{ServiceMethod: "Foo.Sum", Seq: 4}, Args{Num1: 2, Num2: 2}, &reply)
+	_assert(h.Error == "" && reply == 4, "connection should survive bad bodies, but got %d (%s)", reply, h.Error)
+}
+
+func TestServer_ProtocolMismatch(t *testing.T) {
+	server := NewServer()
+	cliConn, srvConn := net.Pipe()
+	go server.ServerConn(srvConn)
+	go func() { _, _ = cliConn.Write([]byte("GET / HTTP/1.0\r\n\r\n")) }()
+	_, err := cliConn.Read(make([]byte, 1))
+	_assert(err != nil, "expect the server to close a connection speaking another protocol")
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
@@ -17,11 +19,33 @@ type methodType struct{
 	method reflect.Method
 	ArgType reflect.Type
 	ReplyType reflect.Type
+	withCtx bool // 方法的第一个参数是否为 context.Context
+	kind methodKind
 	numCalls uint64
+	numPanics uint64 // 被恢复的 panic 次数
+	idempotent bool // 注册时用 Idempotent 标记过
 }
+// methodKind 是方法的调用方式
+type methodKind uint8
+
+const (
+	unaryMethod        methodKind = iota // 一个请求一个回复
+	serverStreamMethod                   // 最后一个参数是 ServerStream，可以发送多个回复
+	clientStreamMethod                   // 参数是 ClientStream，接收多个请求后回复一次
+	bidiStreamMethod                     // 唯一的参数是 BidiStream，两个方向都可以发送多条消息
+)
+
+// hasReply 表示最后的回复是否带着 reply，流式发送的方法最后只回复状态
+func (m *methodType) hasReply() bool {
+	return m.kind == unaryMethod || m.kind == clientStreamMethod
+}
+
 func (m *methodType)  NumCalls() uint64{
 	return atomic.LoadUint64(&m.numCalls)
 }
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
 func (m *methodType) newArgv() reflect.Value{
 	var argv reflect.Value
 	if m.ArgType.Kind() == reflect.Ptr{
@@ -31,6 +55,15 @@ func (m *methodType) newArgv() reflect.Value{
 	}
 	return argv
 }
+// isEmpty 表示 t 或者 t 指向的是没有字段的结构体，这样的参数和回复不需要编解码，
+// body 用空占位，protobuf 这样只认识自己消息类型的编解码器也能调用
+func isEmpty(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t.NumField() == 0
+}
+
 func (m *methodType) newReplyv() reflect.Value  {
 	//reply 应该是指针
 	replyv := reflect.New(m.ReplyType.Elem())
@@ -43,6 +76,27 @@ func (m *methodType) newReplyv() reflect.Value  {
 	return replyv
 }
 
+// IdempotentKey 是幂等方法的回复元数据里带的 key，客户端据此判断失败的调用能不能重试
+const IdempotentKey = "geerpc-idempotent"
+
+// RegisterOption 是注册服务时的选项
+type RegisterOption func(s *service) error
+
+// Idempotent 把 methods 标记为幂等的，也就是调用多次和调用一次的效果一样。
+// 这些方法的回复会带上 IdempotentKey，xclient 只会重试已经发出去的幂等调用
+func Idempotent(methods ...string) RegisterOption {
+	return func(s *service) error {
+		for _, name := range methods {
+			m := s.method[name]
+			if m == nil {
+				return fmt.Errorf("rpc: method %s.%s not found", s.name, name)
+			}
+			m.idempotent = true
+		}
+		return nil
+	}
+}
+
 func newService(rcvr interface{}) *service{
 	s := new(service)
 	//利用反射获得服务的值和名字等信息
@@ -64,35 +118,75 @@ func (s *service)registerMethods(){
 
 		method := s.typ.Method(i)
 		mtype := method.Type
-		if mtype.NumIn()!=3 ||mtype.NumOut()!=1{
+		if mtype.NumOut()!=1{
 			continue;
 		}
-		if mtype.Out(0) != reflect.TypeOf((*error)(nil)).Elem(){
+		if mtype.Out(0) != typeOfError{
 			continue;
 		}
-		argType := mtype.In(1)
-		replyType := mtype.In(2)
-
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// 支持两种形式: func(T, Args, *Reply) error 和 func(T, context.Context, Args, *Reply) error，
+		// Reply 换成 ServerStream 是服务端流式方法，Args 换成 ClientStream 是客户端流式方法，
+		// 双向流式方法只有一个 BidiStream 参数
+		withCtx := mtype.NumIn() > 1 && mtype.In(1) == typeOfContext
+		numIn := mtype.NumIn()
+		if withCtx {
+			numIn--
+		}
+		var argType, replyType reflect.Type
+		kind := unaryMethod
+		switch {
+		case numIn == 2 && mtype.In(mtype.NumIn()-1) == typeOfBidiStream:
+			argType, kind = typeOfBidiStream, bidiStreamMethod
+		case numIn == 3:
+			argType = mtype.In(mtype.NumIn()-2)
+			replyType = mtype.In(mtype.NumIn()-1)
+			if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+				continue
+			}
+			switch {
+			case argType == typeOfClientStream:
+				kind = clientStreamMethod
+			case replyType == typeOfServerStream:
+				kind = serverStreamMethod
+			}
+		default:
 			continue
 		}
 		s.method[method.Name] = &methodType{
 			method:  method,
 			ArgType: argType,
 			ReplyType: replyType,
+			withCtx: withCtx,
+			kind: kind,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 
 }
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *methodType,argv,replyv reflect.Value) error{
+func (s *service) call(ctx context.Context, m *methodType,argv,replyv reflect.Value) error{
 	atomic.AddUint64(&m.numCalls,1)
 	f := m.method.Func
-	returnValue := f.Call([]reflect.Value{s.rcvr,argv,replyv})
+	in := []reflect.Value{s.rcvr}
+	if m.withCtx {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv)
+	if replyv.IsValid() {
+		in = append(in, replyv) // 双向流式方法没有 reply
+	}
+	returnValue := f.Call(in)
 	if errInter := returnValue[0].Interface(); errInter!=nil{
 		return errInter.(error)
 	}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"geerpc/codec"
+	"geerpc/status"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ServerStream 是服务端流式方法发送消息用的，方法的形式为
+// func(T, Args, ServerStream) error 或 func(T, context.Context, Args, ServerStream) error。
+// 方法返回时流就结束了，返回的 error 作为最后的状态发给客户端。流式调用只支持分帧协议
+type ServerStream interface {
+	Context() context.Context
+	// Send 发送一条消息。客户端的接收窗口满了会阻塞，直到客户端读走消息或者 context 结束，
+	// 所以读得慢的客户端不会让服务端无限制地缓存数据
+	Send(m interface{}) error
+}
+
+// ClientStream 是客户端流式方法接收消息用的，方法的形式为
+// func(T, ClientStream, *Reply) error 或 func(T, context.Context, ClientStream, *Reply) error，
+// 读完所有消息后把结果写进 reply 返回
+type ClientStream interface {
+	Context() context.Context
+	// Recv 把下一条消息解码到 m，客户端调用 CloseSend 并且消息都读完后返回 io.EOF
+	Recv(m interface{}) error
+}
+
+// BidiStream 是双向流式方法使用的，方法的形式为
+// func(T, BidiStream) error 或 func(T, context.Context, BidiStream) error
+type BidiStream interface {
+	ServerStream
+	Recv(m interface{}) error
+}
+
+var (
+	typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+	typeOfClientStream = reflect.TypeOf((*ClientStream)(nil)).Elem()
+	typeOfBidiStream   = reflect.TypeOf((*BidiStream)(nil)).Elem()
+)
+
+// serverStream 实现了上面三个接口。消息和普通回复一样通过 sending 锁写到连接上，
+// 收到的消息由读请求的 goroutine 按 Seq 放进 msgs，多个流共用一个连接
+type serverStream struct {
+	ctx     context.Context
+	c       codec.Codec
+	seq     uint64
+	sending *sync.Mutex
+	window  *codec.Window // 客户端的接收窗口
+	closed  bool          // protected by sending，方法返回后不能再发送
+
+	msgs       chan codec.RawMessage // 服务端的接收窗口
+	recvErr    error                 // msgs 关闭的原因，nil 表示客户端正常结束发送
+	recvClosed bool                  // 只在读请求的 goroutine 里使用
+	consumed   int                   // 读走了但还没有通知客户端的消息数
+}
+
+func newServerStream(ctx context.Context, c codec.Codec, seq uint64, sending *sync.Mutex, window uint32) *serverStream {
+	if window == 0 {
+		window = codec.DefaultStreamWindow
+	}
+	return &serverStream{
+		ctx:     ctx,
+		c:       c,
+		seq:     seq,
+		sending: sending,
+		window:  codec.NewWindow(int(window)),
+		msgs:    make(chan codec.RawMessage, codec.DefaultStreamWindow),
+	}
+}
+
+func (st *serverStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *serverStream) Send(m interface{}) error {
+	if err := st.window.Take(st.ctx); err == codec.ErrWindowClosed {
+		return errStreamFinished
+	} else if err != nil {
+		return status.FromContextError(err)
+	}
+	return st.write(&codec.Header{Seq: st.seq, Kind: codec.KindStreamMsg}, m)
+}
+
+var errStreamFinished = status.New(status.Canceled, "rpc server: send on a finished stream")
+
+func (st *serverStream) write(h *codec.Header, body interface{}) error {
+	st.sending.Lock()
+	defer st.sending.Unlock()
+	if st.closed {
+		return errStreamFinished
+	}
+	if err := st.ctx.Err(); err != nil {
+		return status.FromContextError(err)
+	}
+	return st.c.Write(h, body)
+}
+
+func (st *serverStream) Recv(m interface{}) error {
+	var msg codec.RawMessage
+	var ok bool
+	select {
+	case msg, ok = <-st.msgs:
+	case <-st.ctx.Done():
+		return status.FromContextError(st.ctx.Err())
+	}
+	if !ok {
+		if st.recvErr != nil {
+			return st.recvErr
+		}
+		return io.EOF
+	}
+	st.consumed++
+	if st.consumed >= cap(st.msgs)/2 {
+		if err := st.write(&codec.Header{Seq: st.seq, Kind: codec.KindWindowUpdate, Credit: uint32(st.consumed)}, invalidRequest); err != nil {
+			return err
+		}
+		st.consumed = 0
+	}
+	fc, ok := st.c.(*codec.FrameCodec)
+	if !ok {
+		return errNotFramed
+	}
+	if err := fc.Marshaler().Unmarshal(msg, m); err != nil {
+		return status.Errorf(status.InvalidArgument, "rpc server: can't decode stream message: %v", err)
+	}
+	return nil
+}
+
+var errNotFramed = status.New(status.Unimplemented, "rpc server: streaming requires the framed protocol")
+
+// deliver 把客户端的一条消息交给方法，客户端没有遵守窗口时结束接收
+func (st *serverStream) deliver(msg codec.RawMessage) {
+	if st.recvClosed {
+		return
+	}
+	select {
+	case st.msgs <- msg:
+	default:
+		st.closeRecv(status.New(status.ResourceExhausted, "rpc server: client ignored the stream window"))
+	}
+}
+
+// closeRecv 结束接收，err 为 nil 表示客户端调用了 CloseSend
+func (st *serverStream) closeRecv(err error) {
+	if st.recvClosed {
+		return
+	}
+	st.recvClosed = true
+	st.recvErr = err
+	close(st.msgs)
+}
+
+// close 在发送最后的回复之前调用，之后方法里残留的 Send 都会失败
+func (st *serverStream) close() {
+	st.sending.Lock()
+	st.closed = true
+	st.sending.Unlock()
+	st.window.Close()
+}
@@ -0,0 +1,123 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code 是 rpc 错误码，零值 OK 表示没有错误
+type Code uint32
+
+const (
+	OK                 Code = iota
+	Canceled                // 调用方取消
+	Unknown                 // handler 返回的普通 error
+	InvalidArgument         // 请求格式不对、参数解码失败
+	DeadlineExceeded        // 超时，包括服务端 HandleTimeout 和调用方传过来的截止时间
+	NotFound                // 找不到服务或方法
+	PermissionDenied        // 没有权限
+	ResourceExhausted       // 超出限制
+	Unimplemented           // 服务端不支持
+	Internal                // 服务端内部错误，例如 handler panic
+	Unavailable             // 服务暂时不可用
+	Unauthenticated         // 没有通过认证
+)
+
+var codeNames = map[Code]string{
+	OK:                "OK",
+	Canceled:          "Canceled",
+	Unknown:           "Unknown",
+	InvalidArgument:   "InvalidArgument",
+	DeadlineExceeded:  "DeadlineExceeded",
+	NotFound:          "NotFound",
+	PermissionDenied:  "PermissionDenied",
+	ResourceExhausted: "ResourceExhausted",
+	Unimplemented:     "Unimplemented",
+	Internal:          "Internal",
+	Unavailable:       "Unavailable",
+	Unauthenticated:   "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Status 是带错误码的 rpc 错误，handler 直接返回它，客户端用 errors.As 取出来
+type Status struct {
+	Code    Code
+	Message string
+	Details map[string]string // 可选的附加信息
+}
+
+// New returns a Status with the given code and message
+func New(code Code, msg string) *Status {
+	return &Status{Code: code, Message: msg}
+}
+
+// Errorf returns an error with the given code and formatted message
+func Errorf(code Code, format string, a ...interface{}) error {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+// WithDetails 返回带上附加信息的副本
+func (s *Status) WithDetails(kv ...string) *Status {
+	out := &Status{Code: s.Code, Message: s.Message, Details: make(map[string]string, len(s.Details)+len(kv)/2)}
+	for k, v := range s.Details {
+		out.Details[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		out.Details[kv[i]] = kv[i+1]
+	}
+	return out
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// Is 让 errors.Is 按错误码比较，例如 errors.Is(err, service.ErrInternal)
+func (s *Status) Is(target error) bool {
+	t, ok := target.(*Status)
+	return ok && t.Code == s.Code
+}
+
+// FromError 取出 err 链上的 Status
+func FromError(err error) (*Status, bool) {
+	var s *Status
+	if errors.As(err, &s) {
+		return s, true
+	}
+	return nil, false
+}
+
+// Convert 把任意 error 转成 Status，nil 对应 OK，其他普通 error 对应 Unknown
+func Convert(err error) *Status {
+	if err == nil {
+		return &Status{Code: OK}
+	}
+	if s, ok := FromError(err); ok {
+		return s
+	}
+	return FromContextError(err)
+}
+
+// FromContextError 把 context 的错误转成 Canceled 或 DeadlineExceeded
+func FromContextError(err error) *Status {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error())
+	default:
+		return New(Unknown, err.Error())
+	}
+}
+
+// CodeOf returns the code of err, OK for nil and Unknown for errors without a Status
+func CodeOf(err error) Code {
+	return Convert(err).Code
+}
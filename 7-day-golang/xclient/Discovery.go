@@ -13,6 +13,11 @@ type SelectMode int
 const (
 	RandomSelect     SelectMode = iota // select randomly
 	RoundRobinSelect                   // select using Robbin algorithm
+	// 下面的方式由 XClient 的 Balancer 实现，Discovery.Get 不支持
+	WeightedRoundRobinSelect // 按 WeightedDiscovery 给的权重平滑加权轮询
+	LeastOutstandingSelect   // 选正在进行的调用最少的
+	P2CEWMASelect            // 随机选两个，比较延迟的 EWMA 乘以正在进行的调用数
+	ConsistentHashSelect     // 按 WithHashKey 给的键在一致性哈希环上选
 )
 
 type Discovery interface {
@@ -22,6 +27,12 @@ type Discovery interface {
 	GetAll() ([]string, error)
 }
 
+// WeightedDiscovery 是能给出服务端权重的 Discovery，其他 Discovery 的服务端权重都是 1
+type WeightedDiscovery interface {
+	Discovery
+	Weight(rpcAddr string) int
+}
+
 
 // MultiServersDiscovery is a discovery for multi servers without a registry center
 // user provides the server addresses explicitly instead
@@ -29,6 +40,7 @@ type MultiServersDiscovery struct {
 	r       *rand.Rand   // generate random number
 	mu      sync.RWMutex // protect following
 	servers []string
+	weights map[string]int // 没有的地址权重为 1
 	index   int // record the selected position for robin algorithm
 }
 
@@ -41,7 +53,7 @@ func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d.index = d.r.Intn(math.MaxInt32 - 1)
 	return d
 }
-var _ Discovery = (*MultiServersDiscovery)(nil) //确保 实现了接口
+var _ WeightedDiscovery = (*MultiServersDiscovery)(nil) //确保 实现了接口
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
 func (d *MultiServersDiscovery) Refresh() error { //由于本次实现的不需要注册中心，所以直接返回
@@ -56,6 +68,23 @@ func (d *MultiServersDiscovery) Update(servers []string) error { //更新服务
 	return nil
 }
 
+// UpdateWeights 替换服务端的权重，不在 weights 里的地址权重为 1
+func (d *MultiServersDiscovery) UpdateWeights(weights map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = weights
+}
+
+// Weight 返回 rpcAddr 的权重，至少为 1
+func (d *MultiServersDiscovery) Weight(rpcAddr string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if w := d.weights[rpcAddr]; w > 0 {
+		return w
+	}
+	return 1
+}
+
 // Get a server according to mode
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
@@ -0,0 +1,293 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Endpoint 是一个可以选择的服务端
+type Endpoint struct {
+	Addr   string
+	Weight int // WeightedDiscovery 给的权重，至少为 1
+}
+
+// Balancer 从可用的服务端里选一个。XClient 已经去掉了试过的、熔断器打开的地址，
+// 打开健康检查时还去掉了被摘除的地址(全部被摘除时除外)，endpoints 不为空
+type Balancer interface {
+	Pick(ctx context.Context, endpoints []Endpoint) (string, error)
+}
+
+// EndpointsUpdater 是 Balancer 可以选择实现的接口，XClient 每次选择前用 Discovery 的完整列表调用它，
+// 包括不可用的地址，列表变化时 Balancer 可以据此重建自己的状态
+type EndpointsUpdater interface {
+	UpdateEndpoints(all []Endpoint)
+}
+
+// Observer 是 Balancer 可以选择实现的接口，XClient 在每次调用服务端的开始和结束时通知它，
+// 包括 Broadcast 的调用。熔断器拒绝的调用没有发出去，不会通知；健康检查的 ping 也不会通知
+type Observer interface {
+	Start(rpcAddr string)
+	Done(rpcAddr string, took time.Duration, err error)
+}
+
+var (
+	balancersMu sync.RWMutex
+	balancers   = map[SelectMode]func() Balancer{
+		WeightedRoundRobinSelect: func() Balancer { return newWeightedRoundRobin() },
+		LeastOutstandingSelect:   func() Balancer { return newLeastOutstanding() },
+		P2CEWMASelect:            func() Balancer { return newP2CEWMA() },
+		ConsistentHashSelect:     func() Balancer { return NewConsistentHash(DefaultVirtualNodes) },
+	}
+)
+
+// RegisterBalancer 让用 mode 创建的 XClient 使用 newBalancer 返回的 Balancer，每个 XClient 调用一次。
+// 用来增加新的选择方式，也可以替换内置的。没有注册的 mode 用 Discovery.Get 选择
+func RegisterBalancer(mode SelectMode, newBalancer func() Balancer) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+	balancers[mode] = newBalancer
+}
+
+func newBalancer(mode SelectMode) Balancer {
+	balancersMu.RLock()
+	defer balancersMu.RUnlock()
+	if f := balancers[mode]; f != nil {
+		return f()
+	}
+	return nil
+}
+
+// SetBalancer 替换 XClient 的 Balancer，nil 表示按 SelectMode 用 Discovery.Get 选择
+func (xc *XClient) SetBalancer(b Balancer) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.balancer = b
+}
+
+func (xc *XClient) getBalancer() Balancer {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.balancer
+}
+
+// pickBalanced 把可以选择的地址交给 b
+func (xc *XClient) pickBalanced(ctx context.Context, b Balancer, tried map[string]bool) (string, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	wd, _ := xc.d.(WeightedDiscovery)
+	all := make([]Endpoint, len(servers))
+	for i, s := range servers {
+		all[i] = Endpoint{Addr: s, Weight: 1}
+		if wd != nil {
+			all[i].Weight = wd.Weight(s)
+		}
+	}
+	if u, ok := b.(EndpointsUpdater); ok {
+		u.UpdateEndpoints(all)
+	}
+	o, bs := xc.detector(), xc.breakerSet()
+	var healthy, ejected []Endpoint
+	open := false
+	for _, ep := range all {
+		s := ep.Addr
+		if tried[s] {
+			continue
+		}
+		if bs != nil && bs.blocked(s) {
+			open = true
+			continue
+		}
+		if o != nil && o.ejected(s) {
+			ejected = append(ejected, ep)
+		} else {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = ejected
+	}
+	switch {
+	case len(healthy) > 0:
+		return b.Pick(ctx, healthy)
+	case open:
+		return "", ErrCircuitOpen
+	}
+	return "", errNoServer
+}
+
+// weightedRoundRobin 是 nginx 的平滑加权轮询: 每次每个地址的 current 加上权重，
+// 选 current 最大的，再把它减去总权重。权重 3:1 时选择的顺序是 a a b a，而不是 a a a b
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(map[string]int)}
+}
+
+func (b *weightedRoundRobin) Pick(_ context.Context, endpoints []Endpoint) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total, best := 0, ""
+	for _, ep := range endpoints {
+		b.current[ep.Addr] += ep.Weight
+		total += ep.Weight
+		if best == "" || b.current[ep.Addr] > b.current[best] {
+			best = ep.Addr
+		}
+	}
+	b.current[best] -= total
+	if len(b.current) > 2*len(endpoints) { // 去掉已经下线的地址
+		alive := make(map[string]bool, len(endpoints))
+		for _, ep := range endpoints {
+			alive[ep.Addr] = true
+		}
+		for addr := range b.current {
+			if !alive[addr] {
+				delete(b.current, addr)
+			}
+		}
+	}
+	return best, nil
+}
+
+// leastOutstanding 选正在进行的调用最少的地址，一样多时随机选一个
+type leastOutstanding struct {
+	mu          sync.Mutex
+	outstanding map[string]int
+	r           *rand.Rand
+}
+
+func newLeastOutstanding() *leastOutstanding {
+	return &leastOutstanding{outstanding: make(map[string]int), r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *leastOutstanding) Pick(_ context.Context, endpoints []Endpoint) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	best, min, ties := "", 0, 0
+	for _, ep := range endpoints {
+		n := b.outstanding[ep.Addr]
+		switch {
+		case best == "" || n < min:
+			best, min, ties = ep.Addr, n, 1
+		case n == min:
+			if ties++; b.r.Intn(ties) == 0 {
+				best = ep.Addr
+			}
+		}
+	}
+	return best, nil
+}
+
+func (b *leastOutstanding) Start(rpcAddr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outstanding[rpcAddr]++
+}
+
+// Done 只减少计数，不看延迟和结果，取消的调用也一样
+func (b *leastOutstanding) Done(rpcAddr string, _ time.Duration, _ error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.outstanding[rpcAddr]--; b.outstanding[rpcAddr] <= 0 {
+		delete(b.outstanding, rpcAddr)
+	}
+}
+
+const (
+	ewmaDecay          = time.Second * 10 // EWMA 的时间常数，也是没有新样本时延迟衰减的速度
+	ewmaFailurePenalty = time.Second      // 失败的调用至少按这么长的延迟算
+)
+
+// p2cEWMA 随机选两个地址，选延迟的 EWMA 乘以(正在进行的调用数+1)小的那个。
+// 没有样本的地址代价为 0，会先被试一次；一段时间没被选中的地址延迟逐渐衰减，之后还会被试到
+type p2cEWMA struct {
+	mu    sync.Mutex
+	r     *rand.Rand
+	stats map[string]*ewmaStat
+}
+
+type ewmaStat struct {
+	ewma        float64 // 纳秒
+	last        time.Time
+	outstanding int
+}
+
+func newP2CEWMA() *p2cEWMA {
+	return &p2cEWMA{r: rand.New(rand.NewSource(time.Now().UnixNano())), stats: make(map[string]*ewmaStat)}
+}
+
+// cost 调用时要持有 mu
+func (b *p2cEWMA) cost(rpcAddr string, now time.Time) float64 {
+	s := b.stats[rpcAddr]
+	if s == nil {
+		return 0
+	}
+	ewma := s.ewma * math.Exp(-float64(now.Sub(s.last))/float64(ewmaDecay))
+	return ewma * float64(s.outstanding+1)
+}
+
+func (b *p2cEWMA) Pick(_ context.Context, endpoints []Endpoint) (string, error) {
+	if len(endpoints) == 1 {
+		return endpoints[0].Addr, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.r.Intn(len(endpoints))
+	j := b.r.Intn(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+	now := time.Now()
+	a, c := endpoints[i].Addr, endpoints[j].Addr
+	if b.cost(c, now) < b.cost(a, now) {
+		return c, nil
+	}
+	return a, nil
+}
+
+func (b *p2cEWMA) Start(rpcAddr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats[rpcAddr]
+	if s == nil {
+		s = &ewmaStat{}
+		b.stats[rpcAddr] = s
+	}
+	s.outstanding++
+}
+
+func (b *p2cEWMA) Done(rpcAddr string, took time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats[rpcAddr]
+	if s == nil {
+		return
+	}
+	s.outstanding--
+	if errors.Is(err, ErrPoolExhausted) || isCanceled(err) {
+		return // 没有发出去或者调用方提前取消了，都不是服务端的延迟
+	}
+	if isFailure(err) && took < ewmaFailurePenalty {
+		took = ewmaFailurePenalty
+	}
+	now := time.Now()
+	if s.last.IsZero() {
+		s.ewma = float64(took)
+	} else {
+		w := math.Exp(-float64(now.Sub(s.last)) / float64(ewmaDecay))
+		s.ewma = s.ewma*w + float64(took)*(1-w)
+	}
+	s.last = now
+}
@@ -0,0 +1,270 @@
+package xclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState 是熔断器的状态
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常调用
+	BreakerOpen                         // 不再调用这个地址，OpenTimeout 后进入半开
+	BreakerHalfOpen                     // 放行少量探测请求，都成功就关闭，有一个失败就重新打开
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrCircuitOpen 表示可选的服务端的熔断器都打开了
+var ErrCircuitOpen = errors.New("rpc xclient: circuit breaker is open")
+
+// BreakerConfig 控制每个地址的熔断器。最近 Window 时间内的调用数不少于 MinRequests 时，
+// 失败的比例达到 ErrorRate 或者慢调用的比例达到 SlowCallRate 就打开熔断器。
+// 失败的判断和健康检查一样，业务错误不算
+type BreakerConfig struct {
+	Window           time.Duration // 统计的滑动窗口，0 表示 DefaultBreakerWindow
+	MinRequests      int           // 0 表示 DefaultBreakerMinRequests
+	ErrorRate        float64       // 0 表示 DefaultBreakerErrorRate
+	SlowCallDuration time.Duration // 超过它的调用算慢调用，0 表示不看延迟
+	SlowCallRate     float64       // 0 表示 DefaultBreakerSlowCallRate
+	OpenTimeout      time.Duration // 打开多久后进入半开，0 表示 DefaultBreakerOpenTimeout
+	HalfOpenRequests int           // 半开时放行的探测请求数，0 表示 1
+	// OnStateChange 在状态变化时调用，不持有锁，可以在里面调用 XClient 的方法
+	OnStateChange func(rpcAddr string, from, to BreakerState)
+}
+
+const (
+	DefaultBreakerWindow       = time.Second * 10
+	DefaultBreakerMinRequests  = 20
+	DefaultBreakerErrorRate    = 0.5
+	DefaultBreakerSlowCallRate = 0.5
+	DefaultBreakerOpenTimeout  = time.Second * 5
+)
+
+const breakerBuckets = 10 // 滑动窗口分成几段
+
+// bucket 是滑动窗口里的一段
+type bucket struct {
+	slot                  int64 // 第几段，UnixNano 除以每段的长度
+	total, failures, slow int
+}
+
+// breaker 是一个地址的熔断器
+type breaker struct {
+	state    BreakerState
+	openedAt time.Time
+	probes   int // 半开时已经放行的请求
+	passed   int // 半开时成功的请求
+	buckets  [breakerBuckets]bucket
+}
+
+// breakerSet 是所有地址的熔断器
+type breakerSet struct {
+	cfg      BreakerConfig
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBreakerSet(cfg BreakerConfig) *breakerSet {
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultBreakerWindow
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerMinRequests
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = DefaultBreakerErrorRate
+	}
+	if cfg.SlowCallRate <= 0 {
+		cfg.SlowCallRate = DefaultBreakerSlowCallRate
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &breakerSet{cfg: cfg, breakers: make(map[string]*breaker)}
+}
+
+// transition 是一次状态变化，释放锁之后再通知
+type transition struct {
+	addr     string
+	from, to BreakerState
+}
+
+func (bs *breakerSet) notify(t *transition) {
+	if t != nil && bs.cfg.OnStateChange != nil {
+		bs.cfg.OnStateChange(t.addr, t.from, t.to)
+	}
+}
+
+// setState 调用时要持有 mu
+func (bs *breakerSet) setState(addr string, b *breaker, to BreakerState, now time.Time) *transition {
+	t := &transition{addr: addr, from: b.state, to: to}
+	b.state = to
+	switch to {
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerHalfOpen:
+		b.probes, b.passed = 0, 0
+	case BreakerClosed:
+		b.buckets = [breakerBuckets]bucket{}
+	}
+	return t
+}
+
+// blocked 判断 rpcAddr 现在是不是不能调用，不占用半开的名额，用于选择服务端
+func (bs *breakerSet) blocked(rpcAddr string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.breakers[rpcAddr]
+	if b == nil {
+		return false
+	}
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) < bs.cfg.OpenTimeout
+	case BreakerHalfOpen:
+		return b.probes >= bs.cfg.HalfOpenRequests
+	}
+	return false
+}
+
+// allow 判断能不能调用 rpcAddr，半开时占用一个探测名额
+func (bs *breakerSet) allow(rpcAddr string) bool {
+	var t *transition
+	defer func() { bs.notify(t) }()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.breakers[rpcAddr]
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < bs.cfg.OpenTimeout {
+			return false
+		}
+		t = bs.setState(rpcAddr, b, BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= bs.cfg.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record 记录一次调用的结果和延迟。调用方取消的和没有发出去的调用看不出服务端好不好，
+// 不计入统计，半开时把探测名额还回去
+func (bs *breakerSet) record(rpcAddr string, err error, took time.Duration) {
+	var t *transition
+	defer func() { bs.notify(t) }()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	ignored := isCanceled(err) || errors.Is(err, ErrPoolExhausted)
+	b := bs.breakers[rpcAddr]
+	if b == nil {
+		if ignored {
+			return
+		}
+		b = &breaker{}
+		bs.breakers[rpcAddr] = b
+	}
+	now := time.Now()
+	failed := isFailure(err)
+	slow := bs.cfg.SlowCallDuration > 0 && took >= bs.cfg.SlowCallDuration
+	switch b.state {
+	case BreakerOpen:
+		return // 打开之前就发出去的调用
+	case BreakerHalfOpen:
+		switch {
+		case ignored:
+			b.probes--
+		case failed || slow:
+			t = bs.setState(rpcAddr, b, BreakerOpen, now)
+		default:
+			if b.passed++; b.passed >= bs.cfg.HalfOpenRequests {
+				t = bs.setState(rpcAddr, b, BreakerClosed, now)
+			}
+		}
+		return
+	}
+	if ignored {
+		return
+	}
+	// 每段的长度是 Window/breakerBuckets，过期的段重新开始计数
+	slot := now.UnixNano() / int64(bs.cfg.Window/breakerBuckets)
+	cur := &b.buckets[slot%breakerBuckets]
+	if cur.slot != slot {
+		*cur = bucket{slot: slot}
+	}
+	cur.total++
+	if failed {
+		cur.failures++
+	}
+	if slow {
+		cur.slow++
+	}
+	var total, failures, slows int
+	for i := range b.buckets {
+		if b.buckets[i].slot > slot-breakerBuckets {
+			total += b.buckets[i].total
+			failures += b.buckets[i].failures
+			slows += b.buckets[i].slow
+		}
+	}
+	if total < bs.cfg.MinRequests {
+		return
+	}
+	if float64(failures) >= bs.cfg.ErrorRate*float64(total) ||
+		(bs.cfg.SlowCallDuration > 0 && float64(slows) >= bs.cfg.SlowCallRate*float64(total)) {
+		t = bs.setState(rpcAddr, b, BreakerOpen, now)
+	}
+}
+
+// state 返回 rpcAddr 的熔断器状态
+func (bs *breakerSet) state(rpcAddr string) BreakerState {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b := bs.breakers[rpcAddr]; b != nil {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// SetBreaker 给每个服务端地址加上熔断器。熔断器打开的地址不会被选中，
+// 剩下的地址都打开时 Call 直接返回 ErrCircuitOpen
+func (xc *XClient) SetBreaker(cfg BreakerConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.breakers = newBreakerSet(cfg)
+}
+
+func (xc *XClient) breakerSet() *breakerSet {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.breakers
+}
+
+// BreakerState 返回 rpcAddr 的熔断器状态，没有设置熔断器时总是 BreakerClosed
+func (xc *XClient) BreakerState(rpcAddr string) BreakerState {
+	if bs := xc.breakerSet(); bs != nil {
+		return bs.state(rpcAddr)
+	}
+	return BreakerClosed
+}
@@ -0,0 +1,112 @@
+package xclient
+
+import (
+	"context"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVirtualNodes 是 ConsistentHashSelect 每个权重的虚拟节点数
+const DefaultVirtualNodes = 100
+
+type hashKey struct{}
+
+// WithHashKey 返回带着哈希键的 ctx，ConsistentHashSelect 把同一个键的请求发给同一个服务端
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKey 返回 WithHashKey 放进 ctx 的键
+func HashKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
+
+// vnode 是环上的一个虚拟节点
+type vnode struct {
+	hash uint32
+	addr string
+}
+
+// consistentHash 是一致性哈希环，每个地址按权重有 replicas*Weight 个虚拟节点，
+// 虚拟节点的位置只和地址有关，所以地址增减时只有它自己的键会移动。
+// 选中的地址不可用时沿着环找下一个可用的，ctx 里没有键时随机选
+type consistentHash struct {
+	replicas int
+
+	mu    sync.Mutex // protect following
+	r     *rand.Rand
+	sig   string  // 当前环对应的地址和权重
+	nodes []vnode // 按 hash 排序
+}
+
+// NewConsistentHash 返回一致性哈希的 Balancer，replicas 是每个权重的虚拟节点数，
+// 不大于 0 时为 DefaultVirtualNodes。ConsistentHashSelect 用的是 NewConsistentHash(DefaultVirtualNodes)
+func NewConsistentHash(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = DefaultVirtualNodes
+	}
+	return &consistentHash{replicas: replicas, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// UpdateEndpoints 在地址或权重变化时重建环
+func (c *consistentHash) UpdateEndpoints(all []Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebuild(all)
+}
+
+// rebuild 调用时要持有 mu
+func (c *consistentHash) rebuild(all []Endpoint) {
+	keys := make([]string, len(all))
+	for i, ep := range all {
+		keys[i] = ep.Addr + "=" + strconv.Itoa(ep.Weight)
+	}
+	sort.Strings(keys)
+	sig := strings.Join(keys, ",")
+	if sig == c.sig {
+		return
+	}
+	nodes := make([]vnode, 0, len(all)*c.replicas)
+	for _, ep := range all {
+		for i := 0; i < c.replicas*ep.Weight; i++ {
+			nodes = append(nodes, vnode{crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + ep.Addr)), ep.Addr})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].hash != nodes[j].hash {
+			return nodes[i].hash < nodes[j].hash
+		}
+		return nodes[i].addr < nodes[j].addr
+	})
+	c.sig, c.nodes = sig, nodes
+}
+
+func (c *consistentHash) Pick(ctx context.Context, endpoints []Endpoint) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := HashKey(ctx)
+	if !ok {
+		return endpoints[c.r.Intn(len(endpoints))].Addr, nil
+	}
+	if len(c.nodes) == 0 { // 没有调用过 UpdateEndpoints
+		c.rebuild(endpoints)
+	}
+	usable := make(map[string]bool, len(endpoints))
+	for _, ep := range endpoints {
+		usable[ep.Addr] = true
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(c.nodes), func(i int) bool { return c.nodes[i].hash >= h })
+	for i := 0; i < len(c.nodes); i++ {
+		if n := c.nodes[(start+i)%len(c.nodes)]; usable[n.addr] {
+			return n.addr, nil
+		}
+	}
+	return endpoints[c.r.Intn(len(endpoints))].Addr, nil // 环上没有可用的地址，列表刚刚变化
+}
@@ -3,11 +3,13 @@ package xclient
 import (
 	"context"
 	"geerpc/client"
+	"geerpc/metadata"
 	"geerpc/service"
 	"io"
 	"log"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,7 +20,19 @@ type XClient struct {
 	mode    SelectMode
 	opt     *service.Option
 	mu      sync.Mutex // protect following
-	clients map[string]*client.Client
+	pools   map[string]*connPool // 每个地址的连接
+	total   int // 所有地址的连接数，包括正在建立的
+	pool    PoolConfig
+	stopReaper chan struct{} // 回收空闲连接的 goroutine，没有时为 nil
+	health  *outlierDetector // 没有打开健康检查时为 nil
+	stopChecker chan struct{} // 主动健康检查的 goroutine，没有时为 nil
+	retry   *retryer // 没有设置重试时为 nil
+	hedge   *hedger // 没有设置对冲时为 nil
+	breakers *breakerSet // 没有设置熔断器时为 nil
+	balancer Balancer // 为 nil 时用 Discovery.Get 选择
+	idempotent sync.Map // 回复里标记过幂等的方法
+	closed  bool
+	interceptors []client.Interceptor
 }
 
 
@@ -63,10 +77,17 @@ func (d *RegistryDiscovery) Refresh() error {
 		return err
 	}
 	servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
+	weights := strings.Split(resp.Header.Get("X-Geerpc-Weights"), ",") // 和 servers 一一对应，老的注册中心没有
 	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
+	d.weights = make(map[string]int)
+	for i, server := range servers {
 		if strings.TrimSpace(server) != "" {
 			d.servers = append(d.servers, strings.TrimSpace(server))
+			if i < len(weights) {
+				if w, err := strconv.Atoi(strings.TrimSpace(weights[i])); err == nil && w > 0 {
+					d.weights[strings.TrimSpace(server)] = w
+				}
+			}
 		}
 	}
 	d.lastUpdate = time.Now()
@@ -91,46 +112,84 @@ func (d *RegistryDiscovery) GetAll() ([]string, error) {
 var _ io.Closer = (*XClient)(nil)
 
 func NewXClient(d Discovery, mode SelectMode, opt *service.Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*client.Client)}
+	return &XClient{d: d, mode: mode, opt: opt, pools: make(map[string]*connPool), balancer: newBalancer(mode)}
 }
 
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		// I have no idea how to deal with error, just ignore it.
-		_ = client.Close()
-		delete(xc.clients, key)
+	xc.closed = true
+	if xc.stopReaper != nil {
+		close(xc.stopReaper)
+		xc.stopReaper = nil
+	}
+	if xc.stopChecker != nil {
+		close(xc.stopChecker)
+		xc.stopChecker = nil
+	}
+	for key, p := range xc.pools {
+		for _, pc := range p.conns {
+			// I have no idea how to deal with error, just ignore it.
+			_ = pc.cli.Close()
+		}
+		xc.total -= len(p.conns)
+		delete(xc.pools, key)
 	}
 	return nil
 }
 
-func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+// Use 注册客户端拦截器，对之后每个连接上的每次调用生效，顺序同 client.Client.Use
+func (xc *XClient) Use(interceptors ...client.Interceptor) {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	cli, ok := xc.clients[rpcAddr] //rpc服务地址
-	if ok && !cli.IsAvailable() {
-		_ = cli.Close()
-		delete(xc.clients, rpcAddr)
-		cli = nil
-	}
-	if cli == nil {
-		var err error
-		cli, err = client.XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+	xc.interceptors = append(xc.interceptors, interceptors...)
+	for _, p := range xc.pools {
+		for _, pc := range p.conns {
+			pc.cli.Use(interceptors...)
 		}
-		xc.clients[rpcAddr] = cli
 	}
-	return cli, nil
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
-	if err != nil {
-		return err
+	_, err := xc.attempt(rpcAddr, ctx, serviceMethod, args, reply)
+	return err
+}
+
+// attempt 在 rpcAddr 上调用一次，sent 表示请求可能已经发给了服务端
+func (xc *XClient) attempt(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (sent bool, err error) {
+	bs := xc.breakerSet()
+	if bs != nil && !bs.allow(rpcAddr) {
+		return false, ErrCircuitOpen
+	}
+	ob, _ := xc.getBalancer().(Observer)
+	if ob != nil {
+		ob.Start(rpcAddr)
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	start := time.Now()
+	pc, err := xc.dial(rpcAddr)
+	if err == nil {
+		var md metadata.MD
+		err = pc.cli.Call(metadata.WithResponse(ctx, &md), serviceMethod, args, reply)
+		pc.release()
+		sent = sentErr(err)
+		if md != nil || err == nil {
+			xc.learn(serviceMethod, md, err)
+		}
+		if md != nil {
+			metadata.DeliverResponse(ctx, md) // 调用方也可能要回复的元数据
+		}
+	}
+	if o := xc.detector(); o != nil {
+		o.report(rpcAddr, err)
+	}
+	took := time.Since(start)
+	if bs != nil {
+		bs.record(rpcAddr, err, took)
+	}
+	if ob != nil {
+		ob.Done(rpcAddr, took, err)
+	}
+	return sent, err
 }
 
 // Call invokes the named function, waits for it to complete,
@@ -138,7 +197,13 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 // xc will choose a proper server.
 //负载均衡的CALL
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	if h := xc.hedger(serviceMethod); h != nil {
+		return xc.callWithHedge(ctx, h, serviceMethod, args, reply)
+	}
+	if r := xc.retryer(); r != nil {
+		return xc.callWithRetry(ctx, r, serviceMethod, args, reply)
+	}
+	rpcAddr, err := xc.pick(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -156,6 +221,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	var e error
 	replyDone := reply == nil // if reply is nil, don't need to set value
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers { //遍历所有server
 		wg.Add(1)
 		go func(rpcAddr string) {
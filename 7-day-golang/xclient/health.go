@@ -0,0 +1,319 @@
+package xclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"geerpc/status"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthConfig 控制 XClient 的健康检查。被动检查看每个地址连续失败的次数，
+// 主动检查定期调用服务端内置的 service.PingMethod，两者的失败都算在连续失败次数里。
+// 连续失败达到 MaxFailures 时摘除这个地址，摘除的时间从 BaseEjection 开始每次翻倍，
+// 到期后重新放回来，再失败一次就立即摘除，成功一次才清零摘除次数
+type HealthConfig struct {
+	MaxFailures   int           // 0 表示 DefaultMaxFailures
+	BaseEjection  time.Duration // 0 表示 DefaultBaseEjection
+	MaxEjection   time.Duration // 0 表示 DefaultMaxEjection
+	CheckInterval time.Duration // 主动检查的间隔，0 表示不做主动检查
+	CheckTimeout  time.Duration // 一次 ping 的超时，0 表示 CheckInterval
+}
+
+const (
+	DefaultMaxFailures  = 5
+	DefaultBaseEjection = time.Second * 10
+	DefaultMaxEjection  = time.Minute * 5
+)
+
+// EndpointStatus 是一个地址的健康状态，用于调试
+type EndpointStatus struct {
+	Addr         string    `json:"addr"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until,omitempty"` // 最近一次摘除的结束时间
+	Ejections    int       `json:"ejections"`               // 连续被摘除的次数
+	Failures     int       `json:"failures"`                // 当前连续失败的次数
+	LastError    string    `json:"last_error,omitempty"`
+	Conns        int       `json:"conns"`
+	Breaker      string    `json:"breaker,omitempty"` // 熔断器的状态，没有设置熔断器时为空
+}
+
+// endpoint 记录一个地址的失败情况
+type endpoint struct {
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	lastErr      string
+}
+
+// outlierDetector 按地址记录调用结果，决定哪些地址被摘除
+type outlierDetector struct {
+	mu        sync.Mutex
+	cfg       HealthConfig
+	endpoints map[string]*endpoint
+}
+
+func newOutlierDetector(cfg HealthConfig) *outlierDetector {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultMaxFailures
+	}
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = DefaultBaseEjection
+	}
+	if cfg.MaxEjection <= 0 {
+		cfg.MaxEjection = DefaultMaxEjection
+	}
+	if cfg.CheckTimeout <= 0 {
+		cfg.CheckTimeout = cfg.CheckInterval
+	}
+	return &outlierDetector{cfg: cfg, endpoints: make(map[string]*endpoint)}
+}
+
+// isFailure 判断 err 是不是服务端的问题。业务错误、调用方取消和本地连接数的限制不算
+func isFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrPoolExhausted) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return true // 连接错误
+	}
+	switch st.Code {
+	case status.DeadlineExceeded, status.Unavailable, status.Internal:
+		return true
+	}
+	return false
+}
+
+// isCanceled 判断 err 是不是调用方自己取消的
+func isCanceled(err error) bool {
+	return status.CodeOf(err) == status.Canceled
+}
+
+// report 记录一次调用的结果
+func (o *outlierDetector) report(addr string, err error) {
+	if err != nil && !isFailure(err) {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ep := o.endpoints[addr]
+	if ep == nil {
+		if err == nil {
+			return
+		}
+		ep = &endpoint{}
+		o.endpoints[addr] = ep
+	}
+	now := time.Now()
+	if err == nil {
+		ep.failures = 0
+		if now.After(ep.ejectedUntil) {
+			ep.ejections = 0
+		}
+		return
+	}
+	ep.failures++
+	ep.lastErr = err.Error()
+	if now.Before(ep.ejectedUntil) {
+		return // 摘除之前就发出去的调用
+	}
+	if ep.failures >= o.cfg.MaxFailures || ep.ejections > 0 {
+		ep.ejections++
+		ep.ejectedUntil = now.Add(o.backoff(ep.ejections))
+		ep.failures = 0
+	}
+}
+
+// backoff 返回第 n 次摘除的时间
+func (o *outlierDetector) backoff(n int) time.Duration {
+	d := o.cfg.BaseEjection
+	for i := 1; i < n && d < o.cfg.MaxEjection; i++ {
+		d *= 2
+	}
+	if d > o.cfg.MaxEjection {
+		d = o.cfg.MaxEjection
+	}
+	return d
+}
+
+func (o *outlierDetector) ejected(addr string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ep := o.endpoints[addr]
+	return ep != nil && time.Now().Before(ep.ejectedUntil)
+}
+
+// SetHealth 打开健康检查，之后选择服务端时跳过被摘除的地址。所有地址都被摘除时仍然按原来的方式选择
+func (xc *XClient) SetHealth(cfg HealthConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.health = newOutlierDetector(cfg)
+	if xc.stopChecker != nil {
+		close(xc.stopChecker)
+		xc.stopChecker = nil
+	}
+	if cfg.CheckInterval > 0 && !xc.closed {
+		xc.stopChecker = make(chan struct{})
+		go xc.check(xc.health, xc.stopChecker)
+	}
+}
+
+func (xc *XClient) detector() *outlierDetector {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.health
+}
+
+// pick 按 SelectMode 选择一个不在 tried 里的地址，有 Balancer 时交给它选，
+// 否则用 Discovery.Get，选中不合适的地址时换成它后面第一个合适的。
+// 熔断器打开的地址不会被选中；剩下的地址都被摘除时仍然选一个。
+// 没有可选的地址时，有熔断器打开的返回 ErrCircuitOpen，否则返回 errNoServer
+func (xc *XClient) pick(ctx context.Context, tried map[string]bool) (string, error) {
+	if b := xc.getBalancer(); b != nil {
+		return xc.pickBalanced(ctx, b, tried)
+	}
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return "", err
+	}
+	o, bs := xc.detector(), xc.breakerSet()
+	usable := func(s string) (ok, ejected bool) {
+		if tried[s] || (bs != nil && bs.blocked(s)) {
+			return false, false
+		}
+		return true, o != nil && o.ejected(s)
+	}
+	if ok, ejected := usable(rpcAddr); ok && !ejected {
+		return rpcAddr, nil
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	start := 0
+	for i, s := range servers {
+		if s == rpcAddr {
+			start = i
+			break
+		}
+	}
+	fallback, open := "", false
+	for i := 0; i < len(servers); i++ {
+		s := servers[(start+i)%len(servers)]
+		ok, ejected := usable(s)
+		if !ok {
+			open = open || (!tried[s] && bs != nil)
+			continue
+		}
+		if !ejected {
+			return s, nil
+		}
+		if fallback == "" {
+			fallback = s
+		}
+	}
+	switch {
+	case fallback != "":
+		return fallback, nil
+	case open:
+		return "", ErrCircuitOpen
+	}
+	return "", errNoServer
+}
+
+// check 定期 ping 所有没有被摘除的地址，摘除到期的地址也会在这里先试一次
+func (xc *XClient) check(o *outlierDetector, stop chan struct{}) {
+	ticker := time.NewTicker(o.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		servers, err := xc.d.GetAll()
+		if err != nil {
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, addr := range servers {
+			if o.ejected(addr) {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), o.cfg.CheckTimeout)
+				defer cancel()
+				o.report(addr, xc.ping(ctx, addr))
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
+
+// ping 直接在连接池的连接上调用 service.PingMethod。健康检查不是业务调用，
+// 不占熔断器半开时的名额，不通知 Balancer，也不经过拦截器，结果只交给 outlierDetector
+func (xc *XClient) ping(ctx context.Context, addr string) error {
+	pc, err := xc.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer pc.release()
+	return pc.cli.Ping(ctx)
+}
+
+// Endpoints 返回发现的地址和有过失败记录的地址的健康状态，按地址排序
+func (xc *XClient) Endpoints() []EndpointStatus {
+	servers, _ := xc.d.GetAll()
+	xc.mu.Lock()
+	o, bs := xc.health, xc.breakers
+	conns := make(map[string]int)
+	for addr, p := range xc.pools {
+		conns[addr] = len(p.conns)
+	}
+	xc.mu.Unlock()
+
+	byAddr := make(map[string]*EndpointStatus)
+	for _, addr := range servers {
+		byAddr[addr] = &EndpointStatus{Addr: addr}
+	}
+	if o != nil {
+		now := time.Now()
+		o.mu.Lock()
+		for addr, ep := range o.endpoints {
+			st := byAddr[addr]
+			if st == nil {
+				st = &EndpointStatus{Addr: addr}
+				byAddr[addr] = st
+			}
+			st.Ejected = now.Before(ep.ejectedUntil)
+			st.EjectedUntil, st.Ejections, st.Failures, st.LastError = ep.ejectedUntil, ep.ejections, ep.failures, ep.lastErr
+		}
+		o.mu.Unlock()
+	}
+	list := make([]EndpointStatus, 0, len(byAddr))
+	for addr, st := range byAddr {
+		st.Conns = conns[addr]
+		if bs != nil {
+			st.Breaker = bs.state(addr).String()
+		}
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// DebugHandler 以 JSON 返回 Endpoints，可以挂在调试用的 HTTP 服务上
+func (xc *XClient) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(xc.Endpoints())
+	})
+}
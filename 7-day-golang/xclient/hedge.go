@@ -0,0 +1,224 @@
+package xclient
+
+import (
+	"context"
+	"geerpc/metadata"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgePolicy 控制对冲请求: 调用 Methods 里的方法时，第一个服务端在最近调用延迟的 Percentile 分位
+// 之内还没有回复，就把同样的请求再发给另一个服务端，用最先成功的回复并取消其他的。
+// 对冲的请求会在服务端重复执行，只应该用于只读的方法。对冲的方法不按 RetryPolicy 重试
+type HedgePolicy struct {
+	Methods    []string      // 开启对冲的方法，格式 Service.Method
+	Percentile float64       // 0 表示 DefaultHedgePercentile
+	MinDelay   time.Duration // 发出对冲请求前最少等待的时间，延迟样本不够时也用它，0 表示 DefaultHedgeMinDelay
+	MaxHedges  int           // 每次调用最多额外发几个请求，0 表示 1
+	// MaxRatio 限制额外的负载，对冲请求数不超过调用数的这个比例，0 表示 DefaultHedgeRatio
+	MaxRatio float64
+}
+
+const (
+	DefaultHedgePercentile = 0.95
+	DefaultHedgeMinDelay   = time.Millisecond * 10
+	DefaultHedgeRatio      = 0.1
+)
+
+const (
+	latencySamples    = 128  // 每个方法记录最近多少次成功调用的延迟
+	minLatencySamples = 10   // 样本少于它时用 MinDelay
+	hedgeCountLimit   = 1000 // 调用数超过它时两个计数都减半，让比例反映最近的情况
+)
+
+// hedger 是设置好默认值的 HedgePolicy，记录每个方法的延迟和对冲的比例
+type hedger struct {
+	HedgePolicy
+	methods map[string]bool
+
+	mu        sync.Mutex // protect following
+	latencies map[string]*latencyWindow
+	calls     float64
+	hedges    float64
+}
+
+// latencyWindow 是一个方法最近的延迟样本
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func newHedger(p HedgePolicy) *hedger {
+	if p.Percentile <= 0 || p.Percentile >= 1 {
+		p.Percentile = DefaultHedgePercentile
+	}
+	if p.MinDelay <= 0 {
+		p.MinDelay = DefaultHedgeMinDelay
+	}
+	if p.MaxHedges <= 0 {
+		p.MaxHedges = 1
+	}
+	if p.MaxRatio <= 0 {
+		p.MaxRatio = DefaultHedgeRatio
+	}
+	h := &hedger{HedgePolicy: p, methods: make(map[string]bool), latencies: make(map[string]*latencyWindow)}
+	for _, m := range p.Methods {
+		h.methods[m] = true
+	}
+	return h
+}
+
+// delay 返回 serviceMethod 发出对冲请求之前等待的时间
+func (h *hedger) delay(serviceMethod string) time.Duration {
+	h.mu.Lock()
+	w := h.latencies[serviceMethod]
+	var samples []time.Duration
+	if w != nil {
+		samples = append(samples, w.samples...)
+	}
+	h.mu.Unlock()
+	if len(samples) < minLatencySamples {
+		return h.MinDelay
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	d := samples[int(h.Percentile*float64(len(samples)-1))]
+	if d < h.MinDelay {
+		return h.MinDelay
+	}
+	return d
+}
+
+// observe 记录一次成功调用的延迟
+func (h *hedger) observe(serviceMethod string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := h.latencies[serviceMethod]
+	if w == nil {
+		w = &latencyWindow{}
+		h.latencies[serviceMethod] = w
+	}
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+}
+
+// start 记录一次调用
+func (h *hedger) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	if h.calls > hedgeCountLimit {
+		h.calls /= 2
+		h.hedges /= 2
+	}
+}
+
+// allow 在对冲请求数不超过比例时占用一个名额
+func (h *hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hedges+1 > h.MaxRatio*h.calls {
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+// SetHedge 设置对冲请求的策略，Methods 为空表示关闭
+func (xc *XClient) SetHedge(p HedgePolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if len(p.Methods) == 0 {
+		xc.hedge = nil
+		return
+	}
+	xc.hedge = newHedger(p)
+}
+
+// hedger 返回 serviceMethod 的对冲策略，没有开启时返回 nil
+func (xc *XClient) hedger(serviceMethod string) *hedger {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.hedge == nil || !xc.hedge.methods[serviceMethod] {
+		return nil
+	}
+	return xc.hedge
+}
+
+// callWithHedge 先调用一个服务端，等待 delay 还没有回复时再调用另一个，返回最先成功的结果。
+// 全部失败时返回第一个错误
+func (xc *XClient) callWithHedge(ctx context.Context, h *hedger, serviceMethod string, args, reply interface{}) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 取消还没有回复的请求
+	type result struct {
+		reply interface{}
+		md    metadata.MD // 每个请求的回复元数据只交给自己，最后只把胜出的交给调用方
+		err   error
+		took  time.Duration
+	}
+	results := make(chan result, h.MaxHedges+1)
+	tried := make(map[string]bool)
+	launch := func() error {
+		rpcAddr, err := xc.pick(ctx, tried)
+		if err != nil {
+			return err
+		}
+		tried[rpcAddr] = true
+		var r interface{}
+		if reply != nil {
+			r = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface() // 每个请求用自己的 reply
+		}
+		go func() {
+			start := time.Now()
+			var md metadata.MD
+			err := xc.call(rpcAddr, metadata.WithResponse(ctx, &md), serviceMethod, args, r)
+			results <- result{r, md, err, time.Since(start)}
+		}()
+		return nil
+	}
+
+	h.start()
+	if err := launch(); err != nil {
+		return err
+	}
+	delay := h.delay(serviceMethod)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	var firstMD metadata.MD
+	for inflight, hedges := 1, 0; inflight > 0; {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				h.observe(serviceMethod, res.took)
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(res.reply).Elem())
+				}
+				if res.md != nil {
+					metadata.DeliverResponse(parent, res.md)
+				}
+				return nil
+			}
+			if firstErr == nil {
+				firstErr, firstMD = res.err, res.md
+			}
+		case <-timer.C:
+			if hedges < h.MaxHedges && h.allow() && launch() == nil {
+				hedges++
+				inflight++
+				timer.Reset(delay)
+			}
+		}
+	}
+	if firstMD != nil {
+		metadata.DeliverResponse(parent, firstMD)
+	}
+	return firstErr
+}
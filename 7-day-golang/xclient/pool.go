@@ -0,0 +1,216 @@
+package xclient
+
+import (
+	"errors"
+	"geerpc/client"
+	"sync/atomic"
+	"time"
+)
+
+// PoolConfig 控制 XClient 对每个服务端地址保持的连接。
+// 一个连接上的写都要排队，调用多的时候可以对同一个地址开多个连接
+type PoolConfig struct {
+	MaxConnsPerAddr   int           // 每个地址最多的连接数，0 表示 1
+	MaxConns          int           // 所有地址加起来最多的连接数，0 表示不限制
+	MaxPendingPerConn int           // 最空闲的连接上正在进行的调用达到它时才新建连接，0 表示 DefaultMaxPendingPerConn
+	IdleTimeout       time.Duration // 没有调用超过这么久的连接会被关闭，0 表示不回收
+}
+
+// DefaultMaxPendingPerConn 是新建连接之前一个连接上最多同时进行的调用数
+const DefaultMaxPendingPerConn = 16
+
+// ErrPoolExhausted 表示连接数已经到了 MaxConns，而且没有空闲的连接可以关闭
+var ErrPoolExhausted = errors.New("rpc xclient: connection limit reached")
+
+func (cfg *PoolConfig) maxPerAddr() int {
+	if cfg.MaxConnsPerAddr <= 0 {
+		return 1
+	}
+	return cfg.MaxConnsPerAddr
+}
+
+func (cfg *PoolConfig) maxPending() int64 {
+	if cfg.MaxPendingPerConn <= 0 {
+		return DefaultMaxPendingPerConn
+	}
+	return int64(cfg.MaxPendingPerConn)
+}
+
+// pooledConn 是池里的一个连接，pending 是通过 XClient 在这个连接上正在进行的调用数
+type pooledConn struct {
+	cli      *client.Client
+	pending  int64 // atomic
+	lastUsed int64 // atomic，最后一次调用结束的时间，UnixNano
+}
+
+func (pc *pooledConn) acquire() {
+	atomic.AddInt64(&pc.pending, 1)
+}
+
+func (pc *pooledConn) release() {
+	atomic.StoreInt64(&pc.lastUsed, time.Now().UnixNano())
+	atomic.AddInt64(&pc.pending, -1)
+}
+
+// idleSince 返回连接空闲的起始时间，有调用在进行时 ok 为 false
+func (pc *pooledConn) idleSince() (t time.Time, ok bool) {
+	if atomic.LoadInt64(&pc.pending) > 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, atomic.LoadInt64(&pc.lastUsed)), true
+}
+
+// connPool 是一个地址上的连接
+type connPool struct {
+	conns   []*pooledConn
+	dialing int // 正在建立的连接数，也算在连接数里
+}
+
+// leastLoaded 返回正在进行的调用最少的连接
+func (p *connPool) leastLoaded() *pooledConn {
+	var best *pooledConn
+	for _, pc := range p.conns {
+		if best == nil || atomic.LoadInt64(&pc.pending) < atomic.LoadInt64(&best.pending) {
+			best = pc
+		}
+	}
+	return best
+}
+
+// SetPool 设置连接池，对之后的调用生效。默认每个地址一个连接，不回收
+func (xc *XClient) SetPool(cfg PoolConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.pool = cfg
+	if xc.stopReaper != nil {
+		close(xc.stopReaper)
+		xc.stopReaper = nil
+	}
+	if cfg.IdleTimeout > 0 && !xc.closed {
+		xc.stopReaper = make(chan struct{})
+		go xc.reap(cfg.IdleTimeout, xc.stopReaper)
+	}
+}
+
+// dial 返回 rpcAddr 上最空闲的连接，它已经被占用，调用结束后要 release。
+// 最空闲的连接也很忙并且没有超过限制时新建一个连接，建立连接的时候不持有锁
+func (xc *XClient) dial(rpcAddr string) (*pooledConn, error) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.closed {
+		return nil, client.ErrShutdown
+	}
+	p := xc.pools[rpcAddr]
+	if p == nil {
+		p = &connPool{}
+		xc.pools[rpcAddr] = p
+	}
+	xc.dropBroken(p)
+	cfg := xc.pool
+	best := p.leastLoaded()
+	if best != nil && (atomic.LoadInt64(&best.pending) < cfg.maxPending() || len(p.conns)+p.dialing >= cfg.maxPerAddr()) {
+		best.acquire()
+		return best, nil
+	}
+	if cfg.MaxConns > 0 && xc.total >= cfg.MaxConns && !xc.closeIdle() {
+		if best != nil {
+			best.acquire()
+			return best, nil
+		}
+		return nil, ErrPoolExhausted
+	}
+	p.dialing++
+	xc.total++
+	xc.mu.Unlock()
+	cli, err := client.XDial(rpcAddr, xc.opt)
+	xc.mu.Lock()
+	p.dialing--
+	if err != nil {
+		xc.total--
+		return nil, err
+	}
+	if xc.closed {
+		xc.total--
+		_ = cli.Close()
+		return nil, client.ErrShutdown
+	}
+	cli.Use(xc.interceptors...)
+	pc := &pooledConn{cli: cli}
+	pc.acquire()
+	p.conns = append(p.conns, pc)
+	return pc, nil
+}
+
+// dropBroken 关闭并移除已经断开的连接，调用时要持有 mu
+func (xc *XClient) dropBroken(p *connPool) {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.cli.IsAvailable() {
+			conns = append(conns, pc)
+			continue
+		}
+		_ = pc.cli.Close()
+		xc.total--
+	}
+	p.conns = conns
+}
+
+// closeIdle 关闭空闲最久的一个连接给新的地址腾出位置，没有空闲的连接时返回 false。调用时要持有 mu
+func (xc *XClient) closeIdle() bool {
+	var (
+		oldest   *pooledConn
+		from     *connPool
+		earliest time.Time
+	)
+	for _, p := range xc.pools {
+		xc.dropBroken(p)
+		for _, pc := range p.conns {
+			if t, ok := pc.idleSince(); ok && (oldest == nil || t.Before(earliest)) {
+				oldest, from, earliest = pc, p, t
+			}
+		}
+	}
+	if oldest == nil {
+		return xc.total < xc.pool.MaxConns
+	}
+	xc.remove(from, oldest)
+	return true
+}
+
+// remove 关闭 p 里的 pc，调用时要持有 mu
+func (xc *XClient) remove(p *connPool, pc *pooledConn) {
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	_ = pc.cli.Close()
+	xc.total--
+}
+
+// reap 定期关闭空闲超过 timeout 的连接
+func (xc *XClient) reap(timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-timeout)
+		xc.mu.Lock()
+		for addr, p := range xc.pools {
+			for _, pc := range append([]*pooledConn(nil), p.conns...) {
+				if t, ok := pc.idleSince(); ok && t.Before(deadline) {
+					xc.remove(p, pc)
+				}
+			}
+			if len(p.conns) == 0 && p.dialing == 0 {
+				delete(xc.pools, addr)
+			}
+		}
+		xc.mu.Unlock()
+	}
+}
@@ -0,0 +1,217 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"geerpc/client"
+	"geerpc/metadata"
+	"geerpc/service"
+	"geerpc/status"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy 控制 XClient.Call 失败后的重试，每次重试都换一个没试过的服务端。
+// 请求没有发出去(连不上、连接已经关闭)时总是可以重试；已经发出去的只有幂等方法并且错误码在 Codes 里时才重试。
+// 幂等方法来自 Idempotent，或者服务端注册时用 service.Idempotent 标记、客户端从回复里学到的。
+// 学到的标记要等收到过这个方法的回复才有，新的 XClient 第一次调用时连接断开不会重试，
+// 需要这种情况也重试的方法要写在 Idempotent 里
+type RetryPolicy struct {
+	MaxAttempts    int           // 包括第一次在内最多调用几次，小于 2 表示不重试
+	Idempotent     []string      // 调用方确定幂等的方法，格式 Service.Method
+	InitialBackoff time.Duration // 第一次重试前等待的时间，之后每次翻倍，0 表示 DefaultInitialBackoff
+	MaxBackoff     time.Duration // 0 表示 DefaultMaxBackoff
+	Jitter         float64       // 等待时间随机浮动的比例，0 表示 DefaultJitter，负数表示不浮动
+	Codes          []status.Code // 可以重试的错误码，空表示 DefaultRetryCodes
+	// 重试预算和 gRPC 的 retry throttling 一样: 令牌最多 BudgetTokens 个，每次失败减 1，
+	// 每次成功加 BudgetRatio，令牌不超过一半时不再重试，避免服务端出问题时重试把流量放大。
+	// BudgetTokens 为 0 表示 DefaultBudgetTokens，BudgetRatio 为 0 表示 DefaultBudgetRatio
+	BudgetTokens float64
+	BudgetRatio  float64
+}
+
+const (
+	DefaultInitialBackoff = time.Millisecond * 50
+	DefaultMaxBackoff     = time.Second
+	DefaultJitter         = 0.2
+	DefaultBudgetTokens   = 10
+	DefaultBudgetRatio    = 0.1
+)
+
+// DefaultRetryCodes 是默认可以重试的错误码，连接断开这种没有错误码的错误当作 Unavailable
+var DefaultRetryCodes = []status.Code{status.Unavailable, status.ResourceExhausted}
+
+// retryer 是设置好默认值的 RetryPolicy 加上它的预算
+type retryer struct {
+	RetryPolicy
+	idempotent map[string]bool
+	mu         sync.Mutex
+	tokens     float64
+	r          *rand.Rand // protected by mu
+}
+
+func newRetryer(p RetryPolicy) *retryer {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.Jitter == 0 {
+		p.Jitter = DefaultJitter
+	}
+	if len(p.Codes) == 0 {
+		p.Codes = DefaultRetryCodes
+	}
+	if p.BudgetTokens <= 0 {
+		p.BudgetTokens = DefaultBudgetTokens
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = DefaultBudgetRatio
+	}
+	r := &retryer{RetryPolicy: p, idempotent: make(map[string]bool), tokens: p.BudgetTokens, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, m := range p.Idempotent {
+		r.idempotent[m] = true
+	}
+	return r
+}
+
+// record 按调用结果更新预算
+func (r *retryer) record(failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if failed {
+		if r.tokens -= 1; r.tokens < 0 {
+			r.tokens = 0
+		}
+	} else if r.tokens += r.BudgetRatio; r.tokens > r.BudgetTokens {
+		r.tokens = r.BudgetTokens
+	}
+}
+
+func (r *retryer) allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens > r.BudgetTokens/2
+}
+
+// retryable 判断失败的调用能不能重试，sent 表示请求可能已经到了服务端
+func (r *retryer) retryable(err error, sent, idempotent bool) bool {
+	if !sent {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	code := status.Unavailable
+	if st, ok := status.FromError(err); ok {
+		code = st.Code
+	}
+	for _, c := range r.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 返回第 n 次重试前等待的时间
+func (r *retryer) backoff(n int) time.Duration {
+	d := r.InitialBackoff
+	for i := 1; i < n && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		r.mu.Lock()
+		f := 1 + r.Jitter*(2*r.r.Float64()-1)
+		r.mu.Unlock()
+		d = time.Duration(float64(d) * f)
+	}
+	return d
+}
+
+// SetRetry 设置 Call 的重试策略，Broadcast 不重试
+func (xc *XClient) SetRetry(p RetryPolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p.MaxAttempts < 2 {
+		xc.retry = nil
+		return
+	}
+	xc.retry = newRetryer(p)
+}
+
+func (xc *XClient) retryer() *retryer {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.retry
+}
+
+// learn 记下回复里带着 service.IdempotentKey 的方法，成功的回复不再带着它时忘掉，
+// 服务端去掉 service.Idempotent 之后不会一直重试下去
+func (xc *XClient) learn(serviceMethod string, md metadata.MD, err error) {
+	if md.Get(service.IdempotentKey) == "true" {
+		xc.idempotent.Store(serviceMethod, true)
+	} else if err == nil {
+		xc.idempotent.Delete(serviceMethod)
+	}
+}
+
+func (xc *XClient) isIdempotent(serviceMethod string) bool {
+	_, ok := xc.idempotent.Load(serviceMethod)
+	return ok
+}
+
+// callWithRetry 调用 serviceMethod，失败时按重试策略换一个服务端再试
+func (xc *XClient) callWithRetry(ctx context.Context, r *retryer, serviceMethod string, args, reply interface{}) error {
+	tried := make(map[string]bool)
+	var err error
+	for n := 0; n < r.MaxAttempts; n++ {
+		if n > 0 {
+			t := time.NewTimer(r.backoff(n))
+			select {
+			case <-ctx.Done():
+				// 调用方不等了，返回 ctx 的错误，上一次的错误放在消息里
+				t.Stop()
+				st := status.FromContextError(ctx.Err())
+				st.Message = "rpc xclient: retry backoff: " + st.Message + ", last error: " + err.Error()
+				return st
+			case <-t.C:
+			}
+		}
+		rpcAddr, perr := xc.pick(ctx, tried)
+		if perr != nil {
+			if err == nil {
+				err = perr
+			}
+			return err
+		}
+		tried[rpcAddr] = true
+		var sent bool
+		sent, err = xc.attempt(rpcAddr, ctx, serviceMethod, args, reply)
+		if err == nil {
+			r.record(false)
+			return nil
+		}
+		retry := r.retryable(err, sent, r.idempotent[serviceMethod] || xc.isIdempotent(serviceMethod))
+		if retry {
+			r.record(true)
+		}
+		if !retry || ctx.Err() != nil || !r.allow() {
+			return err
+		}
+	}
+	return err
+}
+
+// errNoServer 表示每个服务端都已经试过了
+var errNoServer = errors.New("rpc xclient: no more servers to retry")
+
+// sentErr 判断 Call 返回 err 时请求是否可能已经发给了服务端
+func sentErr(err error) bool {
+	return !errors.Is(err, client.ErrShutdown)
+}
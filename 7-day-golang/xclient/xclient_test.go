@@ -0,0 +1,614 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"geerpc/client"
+	"geerpc/codec"
+	"geerpc/metadata"
+	"geerpc/registry"
+	"geerpc/service"
+	"geerpc/status"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// release 每收到一个值放行一个 Block
+var release = make(chan struct{})
+
+func (f Foo) Block(args Args, reply *int) error {
+	<-release
+	*reply = args.Num1
+	return nil
+}
+
+// Flaky 的 fail 不为 0 时所有方法都返回 Unavailable，Get 是幂等的
+type Flaky struct {
+	fail       int32
+	gets, puts int64
+}
+
+func (f *Flaky) Get(args int, reply *int) error {
+	atomic.AddInt64(&f.gets, 1)
+	if atomic.LoadInt32(&f.fail) != 0 {
+		return status.New(status.Unavailable, "flaky")
+	}
+	return nil
+}
+
+func (f *Flaky) Put(args int, reply *int) error {
+	atomic.AddInt64(&f.puts, 1)
+	if atomic.LoadInt32(&f.fail) != 0 {
+		return status.New(status.Unavailable, "flaky")
+	}
+	return nil
+}
+
+func startFlaky(t *testing.T, fail bool) (string, *Flaky) {
+	f := &Flaky{}
+	if fail {
+		f.fail = 1
+	}
+	server := service.NewServer()
+	if err := server.Register(f, service.Idempotent("Get")); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), f
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// startServer 启动一个服务端，返回 tcp@addr 形式的地址
+func startServer(t *testing.T) string {
+	server := service.NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func (xc *XClient) conns(rpcAddr string) int {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p := xc.pools[rpcAddr]; p != nil {
+		return len(p.conns)
+	}
+	return 0
+}
+
+func TestXClient_Pool(t *testing.T) {
+	addr1, addr2 := startServer(t), startServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetPool(PoolConfig{MaxConnsPerAddr: 2, MaxConns: 2, MaxPendingPerConn: 1, IdleTimeout: time.Millisecond * 100})
+
+	// 默认只有一个连接也能完成调用
+	var reply int
+	_assert(xc.Call(context.Background(), "Foo.Sum", &Args{1, 2}, &reply) == nil && reply == 3, "call failed")
+	_assert(xc.conns(addr1) == 1, "expect 1 connection, but got %d", xc.conns(addr1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			_ = xc.Call(context.Background(), "Foo.Block", &Args{1, 0}, &reply)
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	_assert(xc.conns(addr1) == 2, "expect the pool to grow to 2 connections, but got %d", xc.conns(addr1))
+	xc.mu.Lock()
+	p1, p2 := atomic.LoadInt64(&xc.pools[addr1].conns[0].pending), atomic.LoadInt64(&xc.pools[addr1].conns[1].pending)
+	xc.mu.Unlock()
+	_assert(p1+p2 == 3 && p1 > 0 && p2 > 0, "expect calls spread over connections, but got %d and %d", p1, p2)
+
+	// 连接都在用，超过 MaxConns 时不能给新地址建连接
+	err := xc.call(addr2, context.Background(), "Foo.Sum", &Args{1, 2}, &reply)
+	_assert(err == ErrPoolExhausted, "expect ErrPoolExhausted, but got %v", err)
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+	wg.Wait()
+	// 有空闲的连接时关掉一个给新地址
+	err = xc.call(addr2, context.Background(), "Foo.Sum", &Args{1, 2}, &reply)
+	_assert(err == nil && xc.conns(addr1) == 1 && xc.conns(addr2) == 1, "expect an idle connection to be replaced, but got %v", err)
+
+	time.Sleep(time.Millisecond * 300)
+	xc.mu.Lock()
+	total := xc.total
+	xc.mu.Unlock()
+	_assert(total == 0, "expect idle connections to be reaped, but %d left", total)
+}
+
+func TestXClient_Health(t *testing.T) {
+	live := startServer(t)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{live, dead}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHealth(HealthConfig{MaxFailures: 2, BaseEjection: time.Millisecond * 200, CheckInterval: time.Millisecond * 50})
+
+	failed := 0
+	for i := 0; i < 10; i++ {
+		var reply int
+		if xc.Call(context.Background(), "Foo.Sum", &Args{1, 2}, &reply) != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect 2 failures before ejection, but got %d", failed)
+	eps := endpoints(xc)
+	_assert(len(eps) == 2 && eps[dead].Ejected && eps[dead].Ejections == 1 && eps[dead].LastError != "",
+		"expect %s to be ejected, but got %+v", dead, eps)
+	_assert(!eps[live].Ejected && eps[live].Conns == 1, "expect %s to be healthy, but got %+v", live, eps[live])
+
+	// 摘除到期后主动检查再次失败，摘除的时间翻倍
+	time.Sleep(time.Millisecond * 300)
+	ep := endpoints(xc)[dead]
+	_assert(ep.Ejected && ep.Ejections == 2, "expect %s to be ejected again, but got %+v", dead, ep)
+	_assert(time.Until(ep.EjectedUntil) > time.Millisecond*200, "expect a longer back-off, but got %v", time.Until(ep.EjectedUntil))
+}
+
+func TestXClient_HealthCodecs(t *testing.T) {
+	addr := startServer(t)
+	for _, legacy := range []bool{false, true} {
+		for _, typ := range codec.Types() {
+			xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RoundRobinSelect, &service.Option{CodecType: typ, Legacy: legacy})
+			// ping 不经过拦截器
+			var intercepted int64
+			xc.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+				atomic.AddInt64(&intercepted, 1)
+				return invoker(ctx, serviceMethod, args, reply)
+			})
+			xc.SetHealth(HealthConfig{MaxFailures: 1, CheckInterval: time.Millisecond * 20})
+			time.Sleep(time.Millisecond * 100)
+			ep := endpoints(xc)[addr]
+			_assert(!ep.Ejected && ep.LastError == "" && ep.Conns == 1, "%s (legacy %v): expect ping to succeed, but got %+v", typ, legacy, ep)
+			_assert(atomic.LoadInt64(&intercepted) == 0, "%s: expect ping to skip interceptors", typ)
+			_ = xc.Close()
+		}
+	}
+}
+
+func endpoints(xc *XClient) map[string]EndpointStatus {
+	m := make(map[string]EndpointStatus)
+	for _, ep := range xc.Endpoints() {
+		m[ep.Addr] = ep
+	}
+	return m
+}
+
+func TestXClient_Retry(t *testing.T) {
+	badAddr, bad := startFlaky(t, true)
+	goodAddr, good := startFlaky(t, false)
+	xc := NewXClient(NewMultiServerDiscovery([]string{badAddr, goodAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, BudgetTokens: 1000}
+	xc.SetRetry(policy)
+
+	var reply int
+	for i := 0; i < 10; i++ {
+		err := xc.Call(context.Background(), "Flaky.Get", 1, &reply)
+		_assert(err == nil, "expect idempotent calls to be retried on another server, but got %v", err)
+	}
+	goodGets, badGets := atomic.LoadInt64(&good.gets), atomic.LoadInt64(&bad.gets)
+	_assert(goodGets == 10 && badGets > 0, "expect 10 gets on the good server, but got %d (bad %d)", goodGets, badGets)
+
+	failed := 0
+	for i := 0; i < 10; i++ {
+		if err := xc.Call(context.Background(), "Flaky.Put", 1, &reply); err != nil {
+			_assert(status.CodeOf(err) == status.Unavailable, "unexpected error %v", err)
+			failed++
+		}
+	}
+	goodPuts, badPuts := atomic.LoadInt64(&good.puts), atomic.LoadInt64(&bad.puts)
+	_assert(int64(failed) == badPuts && goodPuts+badPuts == 10, "expect non-idempotent calls not to be retried, but got %d/%d", goodPuts, badPuts)
+
+	// 没有发出去的请求不管是不是幂等都可以重试
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{dead, goodAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	xc2.SetRetry(policy)
+	for i := 0; i < 4; i++ {
+		err := xc2.Call(context.Background(), "Flaky.Put", 1, &reply)
+		_assert(err == nil, "expect calls to a dead server to be retried, but got %v", err)
+	}
+
+	// 都失败时预算用到一半就不再重试
+	badAddr2, bad2 := startFlaky(t, true)
+	xc3 := NewXClient(NewMultiServerDiscovery([]string{badAddr, badAddr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc3.Close() }()
+	xc3.SetRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	before := atomic.LoadInt64(&bad.gets)
+	for i := 0; i < 10; i++ {
+		_ = xc3.Call(context.Background(), "Flaky.Get", 1, &reply)
+	}
+	attempts := atomic.LoadInt64(&bad.gets) - before + atomic.LoadInt64(&bad2.gets)
+	_assert(attempts == 12, "expect the retry budget to stop retries after 12 attempts, but got %d", attempts)
+
+	// 等待重试时 ctx 结束，返回 ctx 的错误而不是上一次的错误
+	xc4 := NewXClient(NewMultiServerDiscovery([]string{badAddr, badAddr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc4.Close() }()
+	xc4.SetRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, BudgetTokens: 1000})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err := xc4.Call(ctx, "Flaky.Get", 1, &reply)
+	_assert(status.CodeOf(err) == status.DeadlineExceeded && strings.Contains(err.Error(), "flaky"), "expect DeadlineExceeded during backoff, but got %v", err)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	err = xc4.Call(ctx, "Flaky.Get", 1, &reply)
+	_assert(status.CodeOf(err) == status.Canceled, "expect Canceled during backoff, but got %v", err)
+}
+
+// dropConn 在写第二次(握手之后的第一个回复)时断开，请求已经执行了，客户端却收不到回复
+type dropConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.writes, 1) > 1 {
+		_ = c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+type dropListener struct{ net.Listener }
+
+func (l dropListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &dropConn{Conn: conn}, nil
+}
+
+func TestXClient_RetryDroppedConn(t *testing.T) {
+	drop := &Flaky{}
+	server := service.NewServer()
+	_ = server.Register(drop, service.Idempotent("Get"))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(dropListener{l})
+	dropAddr := "tcp@" + l.Addr().String()
+	goodAddr, good := startFlaky(t, false)
+
+	// 新的 XClient 还没收到过回复，不知道 Get 是幂等的
+	xc := NewXClient(NewMultiServerDiscovery([]string{dropAddr, goodAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBalancer(firstBalancer{})
+	xc.SetRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	var reply int
+	err := xc.Call(context.Background(), "Flaky.Get", 1, &reply)
+	_assert(err != nil && atomic.LoadInt64(&drop.gets) == 1 && atomic.LoadInt64(&good.gets) == 0,
+		"expect an unknown method not to be retried after it was sent, but got %v", err)
+
+	// 调用方声明的幂等方法在连接断开时重试
+	xc.SetRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Idempotent: []string{"Flaky.Get"}})
+	err = xc.Call(context.Background(), "Flaky.Get", 1, &reply)
+	_assert(err == nil && atomic.LoadInt64(&good.gets) == 1, "expect a declared idempotent method to be retried, but got %v", err)
+
+	// 学到的标记在成功的回复不再带着它时忘掉
+	xc.learn("Flaky.Get", metadata.Pairs(service.IdempotentKey, "true"), nil)
+	_assert(xc.isIdempotent("Flaky.Get"), "expect the marker to be learned")
+	xc.learn("Flaky.Get", nil, status.New(status.Unavailable, "down"))
+	_assert(xc.isIdempotent("Flaky.Get"), "expect a failed call to keep the marker")
+	xc.learn("Flaky.Get", nil, nil)
+	_assert(!xc.isIdempotent("Flaky.Get"), "expect the marker to be dropped")
+}
+
+// Slow 的 Read 在 delay 之后回复，被取消时记下次数
+type Slow struct {
+	delay           time.Duration
+	calls, canceled int64
+}
+
+func (s *Slow) Read(ctx context.Context, args int, reply *int) error {
+	atomic.AddInt64(&s.calls, 1)
+	_ = metadata.SetResponse(ctx, metadata.Pairs("delay", s.delay.String()))
+	select {
+	case <-time.After(s.delay):
+		*reply = int(s.delay / time.Millisecond)
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&s.canceled, 1)
+		return ctx.Err()
+	}
+}
+
+func startSlow(t *testing.T, delay time.Duration) (string, *Slow) {
+	s := &Slow{delay: delay}
+	server := service.NewServer()
+	_ = server.Register(s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), s
+}
+
+func TestXClient_Hedge(t *testing.T) {
+	slowAddr, slow := startSlow(t, time.Millisecond*500)
+	fastAddr, fast := startSlow(t, 0)
+	xc := NewXClient(NewMultiServerDiscovery([]string{slowAddr, fastAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHedge(HedgePolicy{Methods: []string{"Slow.Read"}, MinDelay: time.Millisecond * 20, MaxRatio: 1})
+
+	mds := make([]metadata.MD, 6)
+	for i := 0; i < 6; i++ {
+		start := time.Now()
+		reply := -1
+		err := xc.Call(metadata.WithResponse(context.Background(), &mds[i]), "Slow.Read", 1, &reply)
+		_assert(err == nil && reply == 0, "expect the fast reply, but got %d (%v)", reply, err)
+		_assert(time.Since(start) < time.Millisecond*300, "expect the slow server to be hedged, but took %v", time.Since(start))
+		_assert(mds[i].Get("delay") == "0s", "expect the metadata of the fast reply, but got %v", mds[i])
+	}
+	time.Sleep(time.Millisecond * 50)
+	for _, md := range mds {
+		_assert(md.Get("delay") == "0s", "expect losing requests not to overwrite the metadata, but got %v", md)
+	}
+	slowCalls := atomic.LoadInt64(&slow.calls)
+	_assert(slowCalls > 0 && atomic.LoadInt64(&slow.canceled) == slowCalls, "expect hedged losers to be canceled, but got %d/%d", atomic.LoadInt64(&slow.canceled), slowCalls)
+	_assert(atomic.LoadInt64(&fast.calls) == 6, "expect 6 calls on the fast server, but got %d", atomic.LoadInt64(&fast.calls))
+
+	// 对冲请求数不超过调用数的 10%
+	slowAddr2, slow2 := startSlow(t, time.Millisecond*40)
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{slowAddr2, fastAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	// 一半的调用很慢，取低分位保证慢的调用都会想要对冲
+	xc2.SetHedge(HedgePolicy{Methods: []string{"Slow.Read"}, MinDelay: time.Millisecond * 10, Percentile: 0.1})
+	before := atomic.LoadInt64(&fast.calls)
+	for i := 0; i < 20; i++ {
+		var reply int
+		_ = xc2.Call(context.Background(), "Slow.Read", 1, &reply)
+	}
+	time.Sleep(time.Millisecond * 50)
+	extra := atomic.LoadInt64(&slow2.calls) + atomic.LoadInt64(&fast.calls) - before - 20
+	_assert(extra >= 1 && extra <= 2, "expect 1 or 2 hedged requests, but got %d", extra)
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	badAddr, bad := startFlaky(t, true)
+	goodAddr, _ := startFlaky(t, false)
+	xc := NewXClient(NewMultiServerDiscovery([]string{badAddr, goodAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var mu sync.Mutex
+	var changes []string
+	xc.SetBreaker(BreakerConfig{MinRequests: 4, OpenTimeout: time.Millisecond * 100, OnStateChange: func(addr string, from, to BreakerState) {
+		mu.Lock()
+		defer mu.Unlock()
+		_assert(addr == badAddr, "unexpected breaker change on %s", addr)
+		changes = append(changes, from.String()+"->"+to.String())
+	}})
+
+	var reply int
+	for i := 0; i < 20; i++ {
+		_ = xc.Call(context.Background(), "Flaky.Put", 1, &reply)
+	}
+	_assert(atomic.LoadInt64(&bad.puts) == 4 && xc.BreakerState(badAddr) == BreakerOpen,
+		"expect the breaker to open after 4 failures, but got %d calls and state %v", atomic.LoadInt64(&bad.puts), xc.BreakerState(badAddr))
+
+	// 只剩熔断的地址时直接失败
+	only := NewXClient(NewMultiServerDiscovery([]string{badAddr}), RoundRobinSelect, nil)
+	defer func() { _ = only.Close() }()
+	only.SetBreaker(BreakerConfig{MinRequests: 1, OpenTimeout: time.Minute})
+	_ = only.Call(context.Background(), "Flaky.Put", 1, &reply)
+	err := only.Call(context.Background(), "Flaky.Put", 1, &reply)
+	_assert(err == ErrCircuitOpen, "expect ErrCircuitOpen, but got %v", err)
+
+	// 半开时探测失败重新打开，服务端恢复后探测成功就关闭
+	time.Sleep(time.Millisecond * 120)
+	puts := atomic.LoadInt64(&bad.puts)
+	for xc.BreakerState(badAddr) == BreakerOpen && atomic.LoadInt64(&bad.puts) == puts {
+		_ = xc.Call(context.Background(), "Flaky.Put", 1, &reply)
+	}
+	_assert(xc.BreakerState(badAddr) == BreakerOpen, "expect a failed probe to reopen the breaker")
+	atomic.StoreInt32(&bad.fail, 0)
+	time.Sleep(time.Millisecond * 120)
+	for i := 0; i < 4; i++ {
+		_ = xc.Call(context.Background(), "Flaky.Put", 1, &reply)
+	}
+	_assert(xc.BreakerState(badAddr) == BreakerClosed, "expect a successful probe to close the breaker")
+	mu.Lock()
+	got := strings.Join(changes, ",")
+	mu.Unlock()
+	want := "closed->open,open->half-open,half-open->open,open->half-open,half-open->closed"
+	_assert(got == want, "expect state changes %s, but got %s", want, got)
+
+	// 慢调用也会打开熔断器
+	slowAddr, _ := startSlow(t, time.Millisecond*30)
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{slowAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	xc2.SetBreaker(BreakerConfig{MinRequests: 2, SlowCallDuration: time.Millisecond * 20})
+	for i := 0; i < 2; i++ {
+		_ = xc2.Call(context.Background(), "Slow.Read", 1, &reply)
+	}
+	_assert(xc2.BreakerState(slowAddr) == BreakerOpen, "expect slow calls to open the breaker")
+
+	// 半开时调用方取消的探测不算成功也不算失败，名额还回去
+	xc3 := NewXClient(NewMultiServerDiscovery([]string{slowAddr}), RoundRobinSelect, nil)
+	defer func() { _ = xc3.Close() }()
+	xc3.SetBreaker(BreakerConfig{MinRequests: 1, SlowCallDuration: time.Millisecond * 20, OpenTimeout: time.Millisecond * 50})
+	_ = xc3.Call(context.Background(), "Slow.Read", 1, &reply)
+	_assert(xc3.BreakerState(slowAddr) == BreakerOpen, "expect a slow call to open the breaker")
+	time.Sleep(time.Millisecond * 60)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*5, cancel)
+	err = xc3.Call(ctx, "Slow.Read", 1, &reply)
+	_assert(status.CodeOf(err) == status.Canceled, "expect a canceled probe, but got %v", err)
+	_assert(xc3.BreakerState(slowAddr) == BreakerHalfOpen, "expect a canceled probe to keep the breaker half-open, but got %v", xc3.BreakerState(slowAddr))
+	err = xc3.Call(context.Background(), "Slow.Read", 1, &reply)
+	_assert(err == nil && xc3.BreakerState(slowAddr) == BreakerOpen, "expect another probe after a canceled one, but got %v", err)
+}
+
+// firstBalancer 总是选第一个地址
+type firstBalancer struct{}
+
+func (firstBalancer) Pick(_ context.Context, endpoints []Endpoint) (string, error) {
+	return endpoints[0].Addr, nil
+}
+
+func TestXClient_Balancer(t *testing.T) {
+	// 平滑加权轮询按 3:1 分配
+	addr1, f1 := startFlaky(t, false)
+	addr2, f2 := startFlaky(t, false)
+	d := NewMultiServerDiscovery([]string{addr1, addr2})
+	d.UpdateWeights(map[string]int{addr1: 3})
+	xc := NewXClient(d, WeightedRoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	for i := 0; i < 40; i++ {
+		_assert(xc.Call(context.Background(), "Flaky.Put", 1, &reply) == nil, "call failed")
+	}
+	puts1, puts2 := atomic.LoadInt64(&f1.puts), atomic.LoadInt64(&f2.puts)
+	_assert(puts1 == 30 && puts2 == 10, "expect 30/10 calls, but got %d/%d", puts1, puts2)
+
+	// 正在进行的调用最少的优先
+	b1, b2 := startServer(t), startServer(t)
+	lo := NewXClient(NewMultiServerDiscovery([]string{b1, b2}), LeastOutstandingSelect, nil)
+	defer func() { _ = lo.Close() }()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			_ = lo.Call(context.Background(), "Foo.Block", &Args{1, 0}, &reply)
+		}()
+		time.Sleep(time.Millisecond * 50)
+	}
+	_assert(lo.conns(b1) == 1 && lo.conns(b2) == 1, "expect one blocked call on each server")
+	release <- struct{}{}
+	release <- struct{}{}
+	wg.Wait()
+
+	// EWMA 延迟低的优先，两个地址都有样本后只选快的
+	slowAddr, slow := startSlow(t, time.Millisecond*20)
+	fastAddr, fast := startSlow(t, 0)
+	p2c := NewXClient(NewMultiServerDiscovery([]string{slowAddr, fastAddr}), P2CEWMASelect, nil)
+	defer func() { _ = p2c.Close() }()
+	for i := 0; i < 20; i++ {
+		_assert(p2c.Call(context.Background(), "Slow.Read", 1, &reply) == nil, "call failed")
+	}
+	slowCalls, fastCalls := atomic.LoadInt64(&slow.calls), atomic.LoadInt64(&fast.calls)
+	_assert(slowCalls == 1 && fastCalls == 19, "expect 1/19 calls, but got %d/%d", slowCalls, fastCalls)
+	// 调用方取消的调用不计入延迟
+	ewma := newP2CEWMA()
+	ewma.Start(fastAddr)
+	ewma.Done(fastAddr, time.Second, status.New(status.Canceled, "canceled"))
+	st := ewma.stats[fastAddr]
+	_assert(st.outstanding == 0 && st.ewma == 0 && st.last.IsZero(), "expect canceled calls not to be learned, but got %+v", *st)
+
+	// 自定义的 Balancer，重试时不会再选试过的地址
+	const firstSelect SelectMode = 100
+	RegisterBalancer(firstSelect, func() Balancer { return firstBalancer{} })
+	badAddr, bad := startFlaky(t, true)
+	custom := NewXClient(NewMultiServerDiscovery([]string{badAddr, addr2}), firstSelect, nil)
+	defer func() { _ = custom.Close() }()
+	custom.SetRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	_assert(custom.Call(context.Background(), "Flaky.Get", 1, &reply) == nil, "expect the retry to pick the next server")
+	_assert(atomic.LoadInt64(&bad.gets) == 1, "expect the custom balancer to pick %s first", badAddr)
+}
+
+func TestRegistryDiscovery_Weights(t *testing.T) {
+	reg := httptest.NewServer(registry.New(time.Minute))
+	defer reg.Close()
+	registry.HeartbeatWeight(reg.URL, "tcp@a", 5, time.Minute)
+	registry.Heartbeat(reg.URL, "tcp@b", time.Minute)
+	d := NewRegistryDiscovery(reg.URL, 0)
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 2, "expect 2 servers, but got %v (%v)", servers, err)
+	_assert(d.Weight("tcp@a") == 5 && d.Weight("tcp@b") == 1, "expect weights 5 and 1, but got %d and %d", d.Weight("tcp@a"), d.Weight("tcp@b"))
+}
+
+func TestXClient_ConsistentHash(t *testing.T) {
+	servers := []string{"tcp@a", "tcp@b", "tcp@c"}
+	d := NewMultiServerDiscovery(servers)
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	defer func() { _ = xc.Close() }()
+	owners := func() map[string]string {
+		m := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			addr, err := xc.pick(WithHashKey(context.Background(), key), nil)
+			_assert(err == nil, "pick failed: %v", err)
+			m[key] = addr
+		}
+		return m
+	}
+	before := owners()
+	count := make(map[string]int)
+	for _, addr := range before {
+		count[addr]++
+	}
+	for _, addr := range servers {
+		_assert(count[addr] > 200, "expect keys spread over servers, but got %v", count)
+	}
+	again := owners()
+	for key, addr := range before {
+		_assert(again[key] == addr, "expect key %s to stay on %s, but got %s", key, addr, again[key])
+	}
+
+	// 去掉一个地址只移动它的键，加上一个地址只把键移给它
+	_ = d.Update([]string{"tcp@a", "tcp@c"})
+	removed := owners()
+	for key, addr := range before {
+		_assert(addr == "tcp@b" || removed[key] == addr, "expect key %s to stay on %s, but moved to %s", key, addr, removed[key])
+	}
+	_ = d.Update([]string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"})
+	added := owners()
+	moved := 0
+	for key, addr := range before {
+		if added[key] != addr {
+			_assert(added[key] == "tcp@d", "expect key %s to move to tcp@d, but moved to %s", key, added[key])
+			moved++
+		}
+	}
+	_assert(moved > 100 && moved < 400, "expect about a quarter of the keys to move, but got %d", moved)
+
+	// 同一个键的调用都发给同一个服务端，试过的地址沿环换下一个
+	addr1, f1 := startFlaky(t, false)
+	addr2, f2 := startFlaky(t, false)
+	routed := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), ConsistentHashSelect, nil)
+	defer func() { _ = routed.Close() }()
+	ctx := WithHashKey(context.Background(), "user:42")
+	var reply int
+	for i := 0; i < 10; i++ {
+		_assert(routed.Call(ctx, "Flaky.Put", 1, &reply) == nil, "call failed")
+	}
+	puts1, puts2 := atomic.LoadInt64(&f1.puts), atomic.LoadInt64(&f2.puts)
+	_assert(puts1+puts2 == 10 && (puts1 == 0 || puts2 == 0), "expect all calls on one server, but got %d/%d", puts1, puts2)
+	first, _ := routed.pick(ctx, nil)
+	next, err := routed.pick(ctx, map[string]bool{first: true})
+	_assert(err == nil && next != first, "expect the next server on the ring, but got %s (%v)", next, err)
+}